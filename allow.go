@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+)
+
+// permissionError is returned when the user lacks delegated zfs permissions
+type permissionError struct {
+	user    string
+	dataset string
+	missing []string
+}
+
+func (e permissionError) Error() string {
+	return fmt.Sprintf("user %s is missing the delegated zfs permissions %s on %s, grant them with zfs allow",
+		e.user, strings.Join(e.missing, ","), e.dataset)
+}
+
+// checkPermissions ensures the current user holds the delegated permissions
+// on the dataset. Root needs no delegation and is not checked.
+func checkPermissions(ctx context.Context, dataset string, perms []string) error {
+	if os.Geteuid() == 0 || len(perms) == 0 {
+		return nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	groups := make(map[string]bool)
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := user.LookupGroupId(id); err == nil {
+				groups[g.Name] = true
+			}
+		}
+	}
+	out, err := zfsOutput(ctx, "allow", dataset)
+	if err != nil {
+		return err
+	}
+	granted := parseAllow(out, dataset, u.Username, groups)
+	var missing []string
+	for _, p := range perms {
+		if !granted[p] {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return permissionError{user: u.Username, dataset: dataset, missing: missing}
+	}
+	return nil
+}
+
+// parseAllow returns the permissions zfs allow output grants the user or its
+// groups on the dataset, either locally or inherited from an ancestor.
+// Permission sets are not expanded.
+//
+//	---- Permissions on tank ---------------------------------------------
+//	Local+Descendent permissions:
+//		user backup destroy,mount,send,snapshot
+func parseAllow(out []byte, dataset, username string, groups map[string]bool) map[string]bool {
+	var (
+		granted = make(map[string]bool)
+		on      string
+		applies bool
+		s       = bufio.NewScanner(bytes.NewReader(out))
+	)
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "---- Permissions on "):
+			on = strings.Fields(strings.TrimPrefix(trimmed, "---- Permissions on "))[0]
+			applies = false
+		case strings.HasSuffix(trimmed, "permissions:"):
+			scope := strings.TrimSuffix(trimmed, " permissions:")
+			if on == dataset {
+				applies = scope == "Local" || scope == "Local+Descendent"
+			} else {
+				applies = strings.HasPrefix(dataset, on+"/") && (scope == "Descendent" || scope == "Local+Descendent")
+			}
+		case applies && strings.HasPrefix(line, "\t"):
+			fields := strings.Fields(trimmed)
+			var perms string
+			switch {
+			case len(fields) == 3 && fields[0] == "user" && fields[1] == username,
+				len(fields) == 3 && fields[0] == "group" && groups[fields[1]]:
+				perms = fields[2]
+			case len(fields) == 2 && fields[0] == "everyone":
+				perms = fields[1]
+			}
+			for _, p := range strings.Split(perms, ",") {
+				if p != "" {
+					granted[p] = true
+				}
+			}
+		}
+	}
+	return granted
+}
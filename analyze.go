@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var analyzeCommand = cli.Command{
+	Name:      "analyze",
+	Usage:     "estimate dataset churn from recent snapshots and suggest a schedule",
+	ArgsUsage: "[dataset...]",
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "window,w",
+			Usage: "only consider snapshots created within the window",
+			Value: Week,
+		},
+		depthFlag,
+		datasetFileFlag,
+		profileFlag,
+		outputFlag,
+	},
+	Action: func(clix *cli.Context) error {
+		if err := validateOutput(clix.String("output")); err != nil {
+			return err
+		}
+		entries, err := datasetEntries(clix)
+		if err != nil {
+			return err
+		}
+		var (
+			mark   = time.Now().Add(-clix.Duration("window"))
+			report = churnReport{}
+			list   = listOpts{depth: clix.Int("depth"), sortBy: "creation"}
+		)
+		for _, e := range entries {
+			snapshots, err := localhost.snapshots(e.Name, list)
+			if err != nil {
+				return err
+			}
+			report = append(report, analyzeChurn(snapshots, mark)...)
+		}
+		return render(os.Stdout, clix.String("output"), report)
+	},
+}
+
+// churnReport is the estimated churn and suggested schedule of each dataset
+type churnReport []churnResult
+
+type churnResult struct {
+	Dataset   string `json:"dataset"`
+	Snapshots int    `json:"snapshots"`
+	// BytesPerHour is the average written bytes per hour between snapshots
+	BytesPerHour uint64 `json:"bytes_per_hour"`
+	Frequency    string `json:"frequency"`
+	Retention    string `json:"retention"`
+}
+
+func (r churnReport) renderText(w io.Writer) error {
+	for _, c := range r {
+		if c.Snapshots < 2 {
+			if _, err := fmt.Fprintf(w, "%s: not enough recent snapshots to estimate churn\n", c.Dataset); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s: avg %s/hour churn over %d snapshots; %s snapshots advised, retention %s\n",
+			c.Dataset, formatBytes(c.BytesPerHour), c.Snapshots, c.Frequency, c.Retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyzeChurn estimates the churn of each dataset from the bytes written
+// between its snapshots created after mark.
+//
+// The heuristic is deliberately simple: datasets writing less than 10MiB an
+// hour rarely need more than daily snapshots, datasets writing up to 10GiB an
+// hour benefit from hourly snapshots and anything busier from snapshots every
+// 15 minutes so less work is lost between them.
+func analyzeChurn(snapshots []*ExtDataset, mark time.Time) []churnResult {
+	groups := make(map[string][]*ExtDataset)
+	for _, s := range snapshots {
+		if s.Created.Before(mark) {
+			continue
+		}
+		groups[s.BaseName] = append(groups[s.BaseName], s)
+	}
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []churnResult
+	for _, name := range names {
+		group := groups[name]
+		result := churnResult{
+			Dataset:   name,
+			Snapshots: len(group),
+		}
+		if len(group) > 1 {
+			var written uint64
+			// the first snapshot's written covers time before the window
+			for _, s := range group[1:] {
+				written += s.Written
+			}
+			hours := group[len(group)-1].Created.Sub(group[0].Created).Hours()
+			if hours > 0 {
+				result.BytesPerHour = uint64(float64(written) / hours)
+			}
+			result.Frequency, result.Retention = suggestSchedule(result.BytesPerHour)
+		}
+		out = append(out, result)
+	}
+	return out
+}
+
+func suggestSchedule(bytesPerHour uint64) (string, string) {
+	switch {
+	case bytesPerHour < 10*MiB:
+		return "daily", "daily=14"
+	case bytesPerHour < 10*GiB:
+		return "hourly", "hourly=24,daily=14"
+	default:
+		return "15 minute", "frequent=8,hourly=24,daily=7"
+	}
+}
+
+const (
+	KiB = 1 << 10
+	MiB = 1 << 20
+	GiB = 1 << 30
+	TiB = 1 << 40
+)
+
+// formatBytes returns n in human readable binary units
+func formatBytes(n uint64) string {
+	switch {
+	case n >= TiB:
+		return fmt.Sprintf("%.1f TiB", float64(n)/TiB)
+	case n >= GiB:
+		return fmt.Sprintf("%.1f GiB", float64(n)/GiB)
+	case n >= MiB:
+		return fmt.Sprintf("%.1f MiB", float64(n)/MiB)
+	case n >= KiB:
+		return fmt.Sprintf("%.1f KiB", float64(n)/KiB)
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+)
+
+// snapshotProgram is the channel program that checks every snapshot in argv
+// before creating any of them, all within the same transaction group
+const snapshotProgram = `args = ...
+argv = args["argv"]
+for _, name in ipairs(argv) do
+	err = zfs.check.snapshot(name)
+	if err ~= 0 then
+		error("cannot snapshot " .. name .. ": error " .. err)
+	end
+end
+for _, name in ipairs(argv) do
+	err = zfs.sync.snapshot(name)
+	if err ~= 0 then
+		error("cannot snapshot " .. name .. ": error " .. err)
+	end
+end
+`
+
+// errNoPrograms is returned when zfs does not support channel programs
+var errNoPrograms = errors.New("zfs channel programs are not supported")
+
+// atomic snapshots the datasets with a zfs channel program so that all
+// the snapshots of a pool share the same transaction group.
+//
+// Channel programs need OpenZFS 0.8 or FreeBSD 12 and run as root. Zfs has
+// no transaction spanning pools, datasets on different pools are
+// snapshotted with one program per pool. When zfs has no channel programs
+// the datasets are snapshotted one after another.
+func (run *snapshotRun) atomic(entries []datasetEntry) error {
+	var (
+		jobs   []*snapshotJob
+		pools  []string
+		byPool = make(map[string][]*snapshotJob)
+	)
+	for _, e := range entries {
+		job, err := run.prepare(e)
+		if err != nil {
+			run.summary.add(e, nil, err)
+			return err
+		}
+		if job == nil {
+			continue
+		}
+		pool := poolName(e.Name)
+		if _, ok := byPool[pool]; !ok {
+			pools = append(pools, pool)
+		}
+		byPool[pool] = append(byPool[pool], job)
+		jobs = append(jobs, job)
+	}
+	// done are the jobs snapshotted so far, pending returns the jobs from
+	// the job j of the pool i on
+	var done []*snapshotJob
+	pending := func(i, j int) []*snapshotJob {
+		out := append([]*snapshotJob{}, byPool[pools[i]][j:]...)
+		for _, pool := range pools[i+1:] {
+			out = append(out, byPool[pool]...)
+		}
+		return out
+	}
+	for i, pool := range pools {
+		if err := run.ctx.Err(); err != nil {
+			run.failed(jobs, err)
+			return err
+		}
+		err := run.program(pool, byPool[pool])
+		if errors.Is(err, errNoPrograms) {
+			logrus.WithField("pool", pool).Warn("zfs channel programs are not supported, snapshotting sequentially")
+			for j, job := range byPool[pool] {
+				if err := run.take(job); err != nil {
+					return run.stopped(done, pending(i, j), err)
+				}
+				done = append(done, job)
+			}
+			continue
+		}
+		if err != nil {
+			return run.stopped(done, pending(i, 0), err)
+		}
+		done = append(done, byPool[pool]...)
+	}
+	if err := run.finishJobs(jobs); err != nil {
+		return err
+	}
+	return run.sendFailures()
+}
+
+// stopped handles a pool that failed to snapshot, the jobs of the pools
+// already snapshotted are still finished and only the pending ones are
+// recorded as failed with err
+func (run *snapshotRun) stopped(done, pending []*snapshotJob, err error) error {
+	if ferr := run.finishJobs(done); ferr != nil {
+		logrus.WithError(ferr).Error("finishing the snapshotted pools")
+	}
+	run.failed(pending, err)
+	return err
+}
+
+// finishJobs finishes the snapshotted jobs in order, stopping at the first
+// failure that does not continue the run
+func (run *snapshotRun) finishJobs(jobs []*snapshotJob) error {
+	for i, job := range jobs {
+		err := run.finish(job)
+		run.summary.add(job.entry, job, err)
+		if err != nil {
+			if job.stage == "send" && run.continued(job.entry, sendError{err}) {
+				continue
+			}
+			run.failed(jobs[i+1:], err)
+			return err
+		}
+	}
+	return nil
+}
+
+// failed records the jobs not finished when the atomic run stopped on err
+func (run *snapshotRun) failed(jobs []*snapshotJob, err error) {
+	for _, job := range jobs {
+		run.summary.add(job.entry, job, err)
+	}
+}
+
+// program snapshots the jobs of a single pool with snapshotProgram
+func (run *snapshotRun) program(pool string, jobs []*snapshotJob) error {
+	if run.fsfreeze {
+		for _, job := range jobs {
+			unfreeze, err := freeze(run.ctx, job.set)
+			if err != nil {
+				return err
+			}
+			defer unfreeze()
+		}
+	}
+	f, err := ioutil.TempFile("", "flux-snapshot-*.zcp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(snapshotProgram); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	args := []string{"program", pool, f.Name()}
+	for _, job := range jobs {
+		args = append(args, job.set.Name+"@"+job.name)
+	}
+	var stderr bytes.Buffer
+	cmd := command(run.ctx, "zfs", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			msg := strings.TrimSpace(stderr.String())
+			if strings.Contains(msg, "unrecognized command") {
+				return errNoPrograms
+			}
+			return fmt.Errorf("zfs program %s: %s", pool, msg)
+		}
+		return err
+	}
+	for _, job := range jobs {
+		snapshot, err := zfs.GetDataset(job.set.Name + "@" + job.name)
+		if err != nil {
+			return err
+		}
+		if err := run.taken(job, snapshot); err != nil {
+			return err
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"pool":      pool,
+		"snapshots": len(jobs),
+	}).Info("snapshotted atomically")
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/urfave/cli"
+)
+
+var keepBookmarksFlag = cli.IntFlag{
+	Name:  "keep-bookmarks",
+	Usage: "also purge bookmarks keeping the newest of each dataset, the newest is always kept as the base of the next incremental send",
+}
+
+// listBookmarks returns the bookmarks of the dataset and its descendants
+// up to the depth, oldest first
+func listBookmarks(ctx context.Context, name string, opts listOpts) ([]*ExtDataset, error) {
+	args := []string{"list", "-H", "-p", "-t", TypeBookmark, "-o", "name,creation,createtxg,guid"}
+	args = append(args, depthArgs(opts.depth)...)
+	out, err := zfsOutput(ctx, append(args, name)...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		bookmarks []*ExtDataset
+		s         = bufio.NewScanner(bytes.NewReader(out))
+	)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected zfs list output %q", s.Text())
+		}
+		created, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		txg, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		guid, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			i                        = strings.Index(fields[0], "#")
+			label, nameTime, managed = parseSnapshotName(fields[0][i+1:])
+		)
+		bookmarks = append(bookmarks, &ExtDataset{
+			Dataset: &zfs.Dataset{
+				Name: fields[0],
+				Type: TypeBookmark,
+			},
+			BaseName:  fields[0][:i],
+			Created:   time.Unix(created, 0),
+			CreateTXG: txg,
+			GUID:      guid,
+			Label:     label,
+			NameTime:  nameTime,
+			Managed:   managed,
+		})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(bookmarks, func(i, j int) bool {
+		return bookmarks[i].CreateTXG < bookmarks[j].CreateTXG
+	})
+	return bookmarks, nil
+}
+
+// decideBookmarks keeps the newest keep bookmarks of each dataset, and at
+// least the newest one that the next incremental send may be based on
+func decideBookmarks(bookmarks []*ExtDataset, keep int, managedOnly bool) []purgeDecision {
+	if keep < 1 {
+		keep = 1
+	}
+	var (
+		out  []purgeDecision
+		seen = make(map[string]int)
+	)
+	for i := len(bookmarks) - 1; i >= 0; i-- {
+		b := bookmarks[i]
+		if managedOnly && !b.Managed {
+			continue
+		}
+		newer := seen[b.BaseName]
+		seen[b.BaseName]++
+		switch {
+		case newer == 0:
+			out = append(out, purgeDecision{
+				snapshot: b,
+				reason:   "newest bookmark kept for the next incremental send",
+			})
+		case newer < keep:
+			out = append(out, purgeDecision{
+				snapshot: b,
+				reason:   fmt.Sprintf("one of the newest %d bookmarks", keep),
+			})
+		default:
+			out = append(out, purgeDecision{
+				snapshot: b,
+				destroy:  true,
+				reason:   fmt.Sprintf("keeps %d bookmarks, %d newer", keep, newer),
+			})
+		}
+	}
+	// report oldest first like the snapshots
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
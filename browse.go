@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var browseCommand = cli.Command{
+	Name:      "browse",
+	Usage:     "interactively pick a snapshot of a dataset to rollback to or clone",
+	ArgsUsage: "<dataset>",
+	Action: func(clix *cli.Context) error {
+		name := clix.Args().First()
+		if name == "" {
+			return errors.New("no dataset specified")
+		}
+		snapshots, err := localhost.snapshots(name, listOpts{depth: 1, sortBy: "creation"})
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("%s has no snapshots", name)
+		}
+		b := &browser{
+			in:  bufio.NewReader(os.Stdin),
+			out: os.Stdout,
+		}
+		return b.run(snapshots, dryRun(clix))
+	},
+}
+
+// browser is a line based prompt over the snapshots of a dataset
+type browser struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (b *browser) run(snapshots []*ExtDataset, dry bool) error {
+	now := time.Now()
+	for i, s := range snapshots {
+		fmt.Fprintf(b.out, "%3d  %s\t%s (%s)\t%s\n", i+1, shortName(s.Name), formatTime(s.Created), formatAge(now, s.Created), formatBytes(s.Used))
+	}
+	answer, err := b.prompt(fmt.Sprintf("snapshot [1-%d]: ", len(snapshots)))
+	if err != nil {
+		return err
+	}
+	i, err := strconv.Atoi(answer)
+	if err != nil || i < 1 || i > len(snapshots) {
+		return fmt.Errorf("invalid selection %q", answer)
+	}
+	var (
+		target = snapshots[i-1]
+		newer  = snapshots[i:]
+	)
+	action, err := b.prompt("action (rollback, clone, quit): ")
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "rollback":
+		args := rollbackArgs(target, len(newer) > 0)
+		if len(newer) > 0 {
+			fmt.Fprintf(b.out, "rollback destroys %d newer snapshots\n", len(newer))
+		}
+		if dry {
+			fmt.Fprintln(b.out, shellJoin(args))
+			return nil
+		}
+		if !b.confirm(shellJoin(args)) {
+			return nil
+		}
+		logrus.WithField("snapshot", target.Name).Info("rolling back")
+		return target.Rollback(len(newer) > 0)
+	case "clone":
+		dest, err := b.prompt("clone to: ")
+		if err != nil {
+			return err
+		}
+		if dest == "" {
+			return errors.New("no clone dataset specified")
+		}
+		args := []string{"zfs", "clone", target.Name, dest}
+		if dry {
+			fmt.Fprintln(b.out, shellJoin(args))
+			return nil
+		}
+		if !b.confirm(shellJoin(args)) {
+			return nil
+		}
+		logrus.WithFields(logrus.Fields{
+			"snapshot": target.Name,
+			"clone":    dest,
+		}).Info("cloning")
+		_, err = target.Clone(dest, nil)
+		return err
+	case "", "quit", "q":
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+func (b *browser) prompt(question string) (string, error) {
+	fmt.Fprint(b.out, question)
+	line, err := b.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// confirm asks to run the command, anything but yes declines
+func (b *browser) confirm(cmd string) bool {
+	answer, err := b.prompt(cmd + "\nrun? [y/N]: ")
+	return err == nil && (answer == "y" || answer == "yes")
+}
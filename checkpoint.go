@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// runCheckpoint is the saved progress of a snapshot run over many datasets
+type runCheckpoint struct {
+	RunID string   `json:"run_id"`
+	Done  []string `json:"done"`
+}
+
+// checkpoint records the datasets completed in a run so that a failed run
+// can be resumed with --resume-run without redoing them.
+// A nil checkpoint records nothing.
+type checkpoint struct {
+	mu    sync.Mutex
+	state stateDir
+	name  string
+	data  runCheckpoint
+	done  map[string]bool
+}
+
+// newCheckpoint returns the checkpoint of the run, loading the saved
+// progress when resuming
+func newCheckpoint(state stateDir, runID string, resume bool) (*checkpoint, error) {
+	if state == "" {
+		if resume {
+			return nil, errors.New("--resume-run requires --state-dir")
+		}
+		return nil, nil
+	}
+	c := &checkpoint{
+		state: state,
+		name:  "run-" + url.PathEscape(runID) + ".checkpoint.json",
+		data:  runCheckpoint{RunID: runID},
+		done:  make(map[string]bool),
+	}
+	if !resume {
+		return c, nil
+	}
+	if _, err := state.load(c.name, &c.data); err != nil {
+		return nil, fmt.Errorf("load checkpoint of run %s: %w", runID, err)
+	}
+	for _, name := range c.data.Done {
+		c.done[name] = true
+	}
+	return c, nil
+}
+
+// runID returns the run id for the datasets, the same datasets always
+// share the id
+func runID(entries []datasetEntry) string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func (c *checkpoint) isDone(name string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[name]
+}
+
+// markDone records the dataset as completed
+func (c *checkpoint) markDone(name string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[name] = true
+	c.data.Done = append(c.data.Done, name)
+	return c.state.save(c.name, c.data)
+}
+
+// clear removes the checkpoint once the run completed
+func (c *checkpoint) clear() error {
+	if c == nil {
+		return nil
+	}
+	return c.state.remove(c.name)
+}
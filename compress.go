@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var compressFlag = cli.StringFlag{
+	Name:  "compress",
+	Usage: "compress the stream over ssh with gzip, lz4, xz or zstd, the program must exist on both hosts",
+}
+
+var compressCmdFlag = cli.StringFlag{
+	Name:  "compress-cmd",
+	Usage: "local command compressing stdin to stdout instead of a --compress preset (zstd -T0 -3), requires --decompress-cmd",
+}
+
+var decompressCmdFlag = cli.StringFlag{
+	Name:  "decompress-cmd",
+	Usage: "remote shell command decompressing the stream of --compress-cmd (zstd -d)",
+}
+
+var compressThresholdFlag = cli.Uint64Flag{
+	Name:  "compress-threshold",
+	Usage: "skip --compress for streams zfs estimates below this many bytes",
+}
+
+// compressors are the programs supported by --compress, all of them
+// compress stdin to stdout with -c and decompress with -dc
+var compressors = map[string]bool{
+	"gzip": true,
+	"lz4":  true,
+	"xz":   true,
+	"zstd": true,
+}
+
+// streamCompressor compresses the stream locally and decompresses it on
+// the remote before the recv
+type streamCompressor struct {
+	// compress is the local command and its arguments
+	compress []string
+	// decompress is the remote shell command
+	decompress string
+}
+
+// newCompressor returns the compressor of the preset or of the custom
+// commands, nil when the stream is not compressed
+func newCompressor(preset, cmd, decmd string) *streamCompressor {
+	if cmd != "" {
+		return &streamCompressor{
+			compress:   strings.Fields(cmd),
+			decompress: decmd,
+		}
+	}
+	if preset == "" {
+		return nil
+	}
+	return &streamCompressor{
+		compress:   []string{preset, "-c"},
+		decompress: preset + " -dc",
+	}
+}
+
+func validateCompress(preset, cmd, decmd string) error {
+	if preset != "" && !compressors[preset] {
+		return fmt.Errorf("unsupported compressor %q", preset)
+	}
+	if cmd == "" && decmd == "" {
+		return nil
+	}
+	switch {
+	case preset != "":
+		return errors.New("--compress cannot be used with --compress-cmd")
+	case len(strings.Fields(cmd)) == 0 || strings.TrimSpace(decmd) == "":
+		return errors.New("--compress-cmd and --decompress-cmd must both be set")
+	}
+	if _, err := exec.LookPath(strings.Fields(cmd)[0]); err != nil {
+		return fmt.Errorf("compress-cmd: %w", err)
+	}
+	return nil
+}
+
+// decompressRemote returns the remote running the recv behind the decompressor
+func decompressRemote(r *remote, c *streamCompressor) *remote {
+	d := *r
+	tmpl := r.recvCmd
+	if tmpl == "" {
+		tmpl = "{recv}"
+	}
+	d.recvCmd = strings.Replace(tmpl, "{recv}", c.decompress+" | {recv}", 1)
+	return &d
+}
+
+// compressor starts the compressor writing into w and returns the writer
+// feeding it along with a func closing its input and waiting for it to exit
+func compressor(ctx context.Context, c *streamCompressor, w io.Writer) (io.Writer, func() error, error) {
+	cmd := command(ctx, c.compress[0], c.compress[1:]...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	return in, func() error {
+		in.Close()
+		return cmd.Wait()
+	}, nil
+}
+
+// estimateSize returns the size zfs estimates for the stream of a send
+func estimateSize(ctx context.Context, sendArgs []string) (uint64, error) {
+	args := append([]string{sendArgs[0], "-n", "-P"}, sendArgs[1:]...)
+	out, err := command(ctx, "zfs", args...).Output()
+	if err != nil {
+		return 0, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == "size" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, errors.New("no size in zfs send estimate")
+}
+
+var sizeToleranceFlag = cli.Float64Flag{
+	Name:  "size-tolerance",
+	Usage: "warn when an uncompressed incremental stream differs from the zfs estimate by more than the percentage, a sign of truncation",
+}
+
+// checkStreamSize compares the bytes sent by an incremental send with the
+// size zfs estimates for its stream and warns on a gross difference
+func checkStreamSize(ctx context.Context, sendArgs []string, sent int64, tolerance float64) {
+	size, err := estimateSize(ctx, sendArgs)
+	if err != nil {
+		logrus.WithError(err).Warn("estimate send size to check the stream")
+		return
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"snapshot":  sendArgs[len(sendArgs)-1],
+		"sent":      sent,
+		"estimated": size,
+	})
+	if size == 0 {
+		log.Debug("checked stream size")
+		return
+	}
+	diff := math.Abs(float64(sent)-float64(size)) / float64(size) * 100
+	if diff > tolerance {
+		log.WithField("difference", fmt.Sprintf("%.1f%%", diff)).Warn("stream size differs from the zfs estimate, the transfer may be truncated")
+		return
+	}
+	log.Debug("checked stream size")
+}
+
+// useCompression returns the compressor for the send, none when the
+// estimated stream is below the threshold
+func useCompression(ctx context.Context, opts sendOpts, sendArgs []string) *streamCompressor {
+	if opts.compress == nil || opts.compressThreshold == 0 {
+		return opts.compress
+	}
+	size, err := estimateSize(ctx, sendArgs)
+	if err != nil {
+		logrus.WithError(err).Warn("estimate send size, compressing")
+		return opts.compress
+	}
+	if size < opts.compressThreshold {
+		logrus.WithFields(logrus.Fields{
+			"snapshot": sendArgs[len(sendArgs)-1],
+			"size":     formatBytes(size),
+		}).Info("skipping compression of small stream")
+		return nil
+	}
+	return opts.compress
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var datasetFileFlag = cli.StringFlag{
+	Name:  "dataset-file",
+	Usage: "file listing a dataset per line with optional target=, dest=, label=, older-than=, retention= and schedule= overrides, grouped in [profile] sections",
+}
+
+var profileFlag = cli.StringFlag{
+	Name:  "profile",
+	Usage: "only use the datasets of the [profile] section of the dataset file",
+}
+
+var validProfile = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var datasetRegexFlag = cli.StringFlag{
+	Name:  "dataset-regex",
+	Usage: "only operate on datasets whose full name matches the regular expression, unanchored unless ^ and $ are used, datasets excluded with flux:exclude-recursive stay excluded",
+}
+
+// datasetRegex returns the compiled --dataset-regex, nil when not set
+func datasetRegex(clix *cli.Context) (*regexp.Regexp, error) {
+	expr := clix.String("dataset-regex")
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --dataset-regex: %w", err)
+	}
+	return re, nil
+}
+
+// matchEntries returns the entries whose dataset matches the expression
+func matchEntries(entries []datasetEntry, re *regexp.Regexp) []datasetEntry {
+	if re == nil {
+		return entries
+	}
+	var out []datasetEntry
+	for _, e := range entries {
+		if re.MatchString(e.Name) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// datasetEntry is a dataset to operate on and its settings
+type datasetEntry struct {
+	Name      string
+	Target    string
+	Dest      string
+	Label     string
+	OlderThan time.Duration
+	Retention map[string]int
+	// Schedules expand the entry into an entry per schedule
+	Schedules []schedule
+	// MinInterval overrides --min-interval for the entry
+	MinInterval time.Duration
+	// Parent is an ancestor added by --include-parents, it is only snapshotted
+	Parent bool
+}
+
+func (e datasetEntry) validate() error {
+	if e.Name == "" || strings.Contains(e.Name, "@") {
+		return fmt.Errorf("invalid dataset %q", e.Name)
+	}
+	if err := validateLabel(e.Label); err != nil {
+		return err
+	}
+	if len(e.Schedules) > 0 && (e.Label != "" || len(e.Retention) > 0) {
+		return errors.New("schedule sets the label and retention, they cannot be combined")
+	}
+	if e.Target != "" && e.Dest == "" {
+		return errors.New("no dest specified")
+	}
+	return nil
+}
+
+// key identifies the entry among the entries of a run, entries expanded
+// from schedules share the dataset name
+func (e datasetEntry) key() string {
+	if e.Label == "" {
+		return e.Name
+	}
+	return e.Name + "@" + e.Label
+}
+
+// policy returns the purge policy for the dataset
+func (e datasetEntry) policy() purgePolicy {
+	return purgePolicy{
+		olderThan:   e.OlderThan,
+		managedOnly: true,
+		label:       e.Label,
+		retention:   e.Retention,
+	}
+}
+
+// defaultEntry returns the dataset settings from the command flags
+func defaultEntry(clix *cli.Context) (datasetEntry, error) {
+	retention, err := parseRetention(clix.String("retention"))
+	if err != nil {
+		return datasetEntry{}, err
+	}
+	olderThan := clix.Duration("older-than")
+	// --newer-than on its own selects every snapshot newer than the mark
+	if clix.Duration("newer-than") > 0 && !clix.IsSet("older-than") && !clix.IsSet("o") {
+		olderThan = 0
+	}
+	schedules, err := parseSchedules(clix.String("schedule"))
+	if err != nil {
+		return datasetEntry{}, err
+	}
+	return datasetEntry{
+		Schedules: schedules,
+		Target:    clix.String("send"),
+		Dest:      clix.String("dest"),
+		Label:     clix.String("label"),
+		OlderThan: olderThan,
+		Retention: retention,
+	}, nil
+}
+
+// datasetEntries returns the datasets given as arguments or in the
+// --dataset-file with the command flags as defaults
+func datasetEntries(clix *cli.Context) ([]datasetEntry, error) {
+	defaults, err := defaultEntry(clix)
+	if err != nil {
+		return nil, err
+	}
+	var entries []datasetEntry
+	for _, name := range clix.Args() {
+		e := defaults
+		e.Name = name
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		entries = append(entries, e.expand()...)
+	}
+	if path := clix.String("dataset-file"); path != "" {
+		fileEntries, err := parseDatasetFile(path, clix.String("profile"), defaults)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fileEntries...)
+	} else if clix.String("profile") != "" {
+		return nil, errors.New("--profile requires --dataset-file")
+	}
+	return entries, nil
+}
+
+// parseDatasetFile parses a dataset per line, blank lines and lines
+// starting with # are ignored. A [profile] line starts a section whose
+// overrides apply to the datasets up to the next section, only the
+// datasets of the profile are returned when set.
+//
+//	tank/home target=backup dest=backup/home label=daily retention=daily=14
+//
+//	[hourly-local] label=hourly retention=hourly=24
+//	tank/db
+func parseDatasetFile(path, profile string, defaults datasetEntry) ([]datasetEntry, error) {
+	entries, invalid, err := readDatasetFile(path, profile, defaults)
+	if err != nil {
+		return nil, err
+	}
+	if len(invalid) > 0 {
+		return nil, invalid[0]
+	}
+	return entries, nil
+}
+
+// readDatasetFile parses every line of the dataset file returning the
+// valid entries of the profile, or of all profiles when empty, along with
+// an error for each invalid line
+func readDatasetFile(path, profile string, defaults datasetEntry) ([]datasetEntry, []error, error) {
+	if profile != "" && !validProfile.MatchString(profile) {
+		return nil, nil, fmt.Errorf("invalid profile %q", profile)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var (
+		entries  []datasetEntry
+		invalid  []error
+		section  string
+		skip     bool
+		base     = defaults
+		profiles = make(map[string]bool)
+		s        = bufio.NewScanner(f)
+	)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			name, b, err := parseProfileLine(text, defaults)
+			if err == nil && profiles[name] {
+				err = fmt.Errorf("duplicate profile %q", name)
+			}
+			if err != nil {
+				invalid = append(invalid, fmt.Errorf("%s:%d: %w", path, line, err))
+				// the datasets of an invalid section are left out
+				skip = true
+				continue
+			}
+			profiles[name] = true
+			section, base, skip = name, b, false
+			continue
+		}
+		if skip || (profile != "" && section != profile) {
+			continue
+		}
+		e, err := parseDatasetLine(text, base)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("%s:%d: %w", path, line, err))
+			continue
+		}
+		entries = append(entries, e.expand()...)
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	if profile != "" && !profiles[profile] {
+		return nil, invalid, fmt.Errorf("%s: unknown profile %q", path, profile)
+	}
+	return entries, invalid, nil
+}
+
+// parseProfileLine parses the name and the overrides of a [profile] line,
+// the overrides are the defaults of the datasets of the section
+func parseProfileLine(text string, defaults datasetEntry) (string, datasetEntry, error) {
+	end := strings.Index(text, "]")
+	if end < 0 {
+		return "", defaults, fmt.Errorf("invalid profile line %q", text)
+	}
+	name := text[1:end]
+	if !validProfile.MatchString(name) {
+		return "", defaults, fmt.Errorf("invalid profile %q", name)
+	}
+	e := defaults
+	for _, field := range strings.Fields(text[end+1:]) {
+		if err := e.set(field); err != nil {
+			return "", defaults, fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	return name, e, nil
+}
+
+// parseDatasetLine parses the dataset and the overrides of a line
+func parseDatasetLine(text string, defaults datasetEntry) (datasetEntry, error) {
+	fields := strings.Fields(text)
+	e := defaults
+	e.Name = fields[0]
+	for _, field := range fields[1:] {
+		if err := e.set(field); err != nil {
+			return e, err
+		}
+	}
+	return e, e.validate()
+}
+
+// set applies a key=value override to the entry
+func (e *datasetEntry) set(field string) error {
+	kv := strings.SplitN(field, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("invalid option %q, expected key=value", field)
+	}
+	switch kv[0] {
+	case "target":
+		e.Target = kv[1]
+	case "dest":
+		e.Dest = kv[1]
+	case "label":
+		e.Label = kv[1]
+	case "older-than":
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return err
+		}
+		e.OlderThan = d
+	case "retention":
+		retention, err := parseRetention(kv[1])
+		if err != nil {
+			return err
+		}
+		e.Retention = retention
+	case "schedule":
+		schedules, err := parseSchedules(kv[1])
+		if err != nil {
+			return err
+		}
+		e.Schedules = schedules
+	default:
+		return fmt.Errorf("unknown option %q", kv[0])
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// flagContext returns the context of a command run with the flags and args
+func flagContext(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func entryNames(entries []datasetEntry) []string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestDatasetRegex(t *testing.T) {
+	entries := []datasetEntry{
+		{Name: "tank"},
+		{Name: "tank/home"},
+		{Name: "tank/home/db"},
+		{Name: "data/tank/home"},
+	}
+	for _, tc := range []struct {
+		expr string
+		want []string
+	}{
+		{expr: "", want: []string{"tank", "tank/home", "tank/home/db", "data/tank/home"}},
+		// unanchored expressions match anywhere in the name
+		{expr: "tank/home", want: []string{"tank/home", "tank/home/db", "data/tank/home"}},
+		{expr: "^tank/home", want: []string{"tank/home", "tank/home/db"}},
+		{expr: "^tank/home$", want: []string{"tank/home"}},
+		{expr: "/db$|^data/", want: []string{"tank/home/db", "data/tank/home"}},
+		{expr: "^backup"},
+	} {
+		re, err := datasetRegex(flagContext(t, []cli.Flag{datasetRegexFlag}, "--dataset-regex", tc.expr))
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		if got := entryNames(matchEntries(entries, re)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: matched %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+	_, err := datasetRegex(flagContext(t, []cli.Flag{datasetRegexFlag}, "--dataset-regex", "tank/(home"))
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid --dataset-regex: ") {
+		t.Errorf("invalid expression: %v", err)
+	}
+}
+
+func TestDatasetRegexExcludeRecursive(t *testing.T) {
+	// zfs list -H -r -t filesystem,volume -o name,flux:exclude-recursive tank
+	fakeCommand(t, "zfs", `printf 'tank\t-\n'
+printf 'tank/home\t-\n'
+printf 'tank/home/cache\ttrue\n'
+printf 'tank/home/cache/thumbs\ttrue\n'
+printf 'tank/home/db\tfalse\n'
+printf 'tank/www\t-\n'
+`)
+	entries, err := expandRecursive(context.Background(), []datasetEntry{{Name: "tank", Target: "backup", Dest: "backup/tank"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := datasetRegex(flagContext(t, []cli.Flag{datasetRegexFlag}, "--dataset-regex", "^tank/home"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the excluded datasets stay excluded even when the expression matches them
+	entries = matchEntries(entries, re)
+	if got, want := entryNames(entries), []string{"tank/home", "tank/home/db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matched %v, want %v", got, want)
+	}
+	for _, e := range entries {
+		if want := "backup/" + e.Name; e.Dest != want {
+			t.Errorf("%s: dest %s, want %s", e.Name, e.Dest, want)
+		}
+	}
+}
+
+func writeDatasetFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "datasets")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadDatasetFile(t *testing.T) {
+	path := writeDatasetFile(t, `# datasets without a section
+tank/home target=backup dest=backup/home
+
+[hourly] label=hourly retention=hourly=24
+tank/db
+tank/www label=frequent
+
+[hourly] label=other
+tank/dup
+
+[bad] retention=hourly
+tank/skipped
+
+[daily] label=daily older-than=48h
+tank/home target=offsite dest=offsite/home
+`)
+	defaults := datasetEntry{Label: "default", OlderThan: time.Hour}
+	type entry struct {
+		name      string
+		target    string
+		label     string
+		olderThan time.Duration
+		retention map[string]int
+	}
+	for _, tc := range []struct {
+		profile string
+		want    []entry
+		invalid []string
+	}{
+		{
+			want: []entry{
+				{name: "tank/home", target: "backup", label: "default", olderThan: time.Hour},
+				{name: "tank/db", label: "hourly", olderThan: time.Hour, retention: map[string]int{"hourly": 24}},
+				// the dataset line overrides its section
+				{name: "tank/www", label: "frequent", olderThan: time.Hour, retention: map[string]int{"hourly": 24}},
+				{name: "tank/home", target: "offsite", label: "daily", olderThan: 48 * time.Hour},
+			},
+			invalid: []string{`:8: duplicate profile "hourly"`, ":11: profile bad: "},
+		},
+		{
+			profile: "hourly",
+			want: []entry{
+				{name: "tank/db", label: "hourly", olderThan: time.Hour, retention: map[string]int{"hourly": 24}},
+				{name: "tank/www", label: "frequent", olderThan: time.Hour, retention: map[string]int{"hourly": 24}},
+			},
+			invalid: []string{`:8: duplicate profile "hourly"`, ":11: profile bad: "},
+		},
+		{
+			profile: "daily",
+			want: []entry{
+				{name: "tank/home", target: "offsite", label: "daily", olderThan: 48 * time.Hour},
+			},
+			invalid: []string{`:8: duplicate profile "hourly"`, ":11: profile bad: "},
+		},
+	} {
+		entries, invalid, err := readDatasetFile(path, tc.profile, defaults)
+		if err != nil {
+			t.Errorf("%q: %v", tc.profile, err)
+			continue
+		}
+		var got []entry
+		for _, e := range entries {
+			got = append(got, entry{name: e.Name, target: e.Target, label: e.Label, olderThan: e.OlderThan, retention: e.Retention})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: entries %+v, want %+v", tc.profile, got, tc.want)
+		}
+		if len(invalid) != len(tc.invalid) {
+			t.Errorf("%q: invalid lines %v, want %v", tc.profile, invalid, tc.invalid)
+			continue
+		}
+		for i, err := range invalid {
+			if !strings.Contains(err.Error(), path+tc.invalid[i]) {
+				t.Errorf("%q: invalid line %v, want %s%s", tc.profile, err, path, tc.invalid[i])
+			}
+		}
+	}
+}
+
+func TestReadDatasetFileProfile(t *testing.T) {
+	path := writeDatasetFile(t, "[daily] label=daily\ntank/home\n")
+	for _, tc := range []struct {
+		profile string
+		err     string
+	}{
+		{profile: "weekly", err: path + `: unknown profile "weekly"`},
+		{profile: "daily/../weekly", err: `invalid profile "daily/../weekly"`},
+	} {
+		if _, _, err := readDatasetFile(path, tc.profile, datasetEntry{}); err == nil || err.Error() != tc.err {
+			t.Errorf("%q: %v, want %s", tc.profile, err, tc.err)
+		}
+	}
+	if _, err := parseDatasetFile(writeDatasetFile(t, "[daily\ntank/home\n"), "", datasetEntry{}); err == nil {
+		t.Error("parsed a dataset file with an unterminated section")
+	}
+}
+
+func TestParseProfileLine(t *testing.T) {
+	defaults := datasetEntry{Target: "backup", Label: "default"}
+	for _, tc := range []struct {
+		line   string
+		name   string
+		target string
+		label  string
+		ok     bool
+	}{
+		{line: "[local]", name: "local", target: "backup", label: "default", ok: true},
+		{line: "[offsite] target=offsite label=weekly", name: "offsite", target: "offsite", label: "weekly", ok: true},
+		{line: "[a.b_c-1]  label=x", name: "a.b_c-1", target: "backup", label: "x", ok: true},
+		{line: "[local"},
+		{line: "[]"},
+		{line: "[my profile]"},
+		{line: "[local] label"},
+		{line: "[local] older-than=soon"},
+	} {
+		name, e, err := parseProfileLine(tc.line, defaults)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: error %v", tc.line, err)
+			continue
+		}
+		if !tc.ok {
+			if !reflect.DeepEqual(e, defaults) {
+				t.Errorf("%q: invalid line changed the defaults to %+v", tc.line, e)
+			}
+			continue
+		}
+		if name != tc.name || e.Target != tc.target || e.Label != tc.label {
+			t.Errorf("%q: parsed %s %s %s", tc.line, name, e.Target, e.Label)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Exit codes of flux, commands return typed errors that map to them
+//
+//	0    success
+//	1    any other failure
+//	2    partial failure, some snapshots could not be destroyed or sent
+//	3    a pool is faulted or suspended
+//	5    a check failed, an incremental chain or a stream did not verify
+//	124  aborted once running longer than --max-runtime
+//	130  interrupted by a signal
+const (
+	exitFailure       = 1
+	exitPartial       = 2
+	exitPoolUnhealthy = 3
+	exitCheckFailed   = 5
+	exitMaxRuntime    = 124
+	exitInterrupted   = 130
+)
+
+// checkError is returned when a verification found problems
+type checkError string
+
+func (e checkError) Error() string {
+	return string(e)
+}
+
+// sendError is the failure of a send after its snapshot was taken
+type sendError struct {
+	err error
+}
+
+func (e sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e sendError) Unwrap() error {
+	return e.err
+}
+
+// destPropsError is the failure to set the --set-prop properties on the
+// destination after the send completed
+type destPropsError struct {
+	err error
+}
+
+func (e destPropsError) Error() string {
+	return e.err.Error()
+}
+
+func (e destPropsError) Unwrap() error {
+	return e.err
+}
+
+// maxRuntimeError is the failure of a command aborted by --max-runtime
+type maxRuntimeError struct {
+	limit time.Duration
+	err   error
+}
+
+func (e maxRuntimeError) Error() string {
+	return fmt.Sprintf("aborted after the max runtime of %s: %v", e.limit, e.err)
+}
+
+func (e maxRuntimeError) Unwrap() error {
+	return e.err
+}
+
+// sendFailures are the datasets whose send failed in a run that continued
+// after the failures
+type sendFailures []string
+
+func (f sendFailures) Error() string {
+	return fmt.Sprintf("%d sends failed: %s", len(f), strings.Join(f, ", "))
+}
+
+// exitCode returns the exit code for the error of a command
+func exitCode(ctx context.Context, err error) int {
+	var (
+		perr poolHealthError
+		derr destroyError
+		serr sendFailures
+		cerr checkError
+		merr maxRuntimeError
+	)
+	switch {
+	case errors.As(err, &merr):
+		return exitMaxRuntime
+	case ctx.Err() != nil || errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.As(err, &perr):
+		return exitPoolUnhealthy
+	case errors.As(err, &derr), errors.As(err, &serr):
+		return exitPartial
+	case errors.As(err, &cerr):
+		return exitCheckFailed
+	}
+	return exitFailure
+}
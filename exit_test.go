@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want int
+	}{
+		{name: "failure", ctx: context.Background(), err: errors.New("failed"), want: exitFailure},
+		{name: "interrupted", ctx: canceled, err: context.Canceled, want: exitInterrupted},
+		{name: "max runtime", ctx: canceled, err: maxRuntimeError{limit: time.Hour, err: context.Canceled}, want: exitMaxRuntime},
+		{name: "partial", ctx: context.Background(), err: sendFailures{"tank/home"}, want: exitPartial},
+	} {
+		if got := exitCode(tc.ctx, tc.err); got != tc.want {
+			t.Errorf("%s: exit code %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+)
+
+// unfreezeTimeout bounds the unfreeze, it runs even when the run is cancelled
+const unfreezeTimeout = 30 * time.Second
+
+// freeze quiesces the mounted filesystem with fsfreeze so the snapshot is
+// a clean image for applications unaware of zfs. Writes to the filesystem
+// block until the returned unfreeze runs, which must be right after the
+// snapshot. Volumes and unmounted filesystems are not frozen.
+func freeze(ctx context.Context, set *zfs.Dataset) (func(), error) {
+	noop := func() {}
+	if set.Type != zfs.DatasetFilesystem {
+		return noop, nil
+	}
+	mounted, err := set.GetProperty("mounted")
+	if err != nil {
+		return nil, err
+	}
+	if mounted != "yes" || !strings.HasPrefix(set.Mountpoint, "/") {
+		logrus.WithField("dataset", set.Name).Debug("not freezing unmounted filesystem")
+		return noop, nil
+	}
+	if out, err := command(ctx, "fsfreeze", "--freeze", set.Mountpoint).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("fsfreeze %s: %s", set.Mountpoint, strings.TrimSpace(string(out)))
+	}
+	logrus.WithField("mountpoint", set.Mountpoint).Debug("frozen")
+	return func() {
+		// unfreeze even when the run was cancelled, the filesystem stays
+		// blocked otherwise
+		ctx, cancel := context.WithTimeout(context.Background(), unfreezeTimeout)
+		defer cancel()
+		if out, err := command(ctx, "fsfreeze", "--unfreeze", set.Mountpoint).CombinedOutput(); err != nil {
+			logrus.WithError(err).WithField("mountpoint", set.Mountpoint).Errorf("unfreeze: %s", strings.TrimSpace(string(out)))
+			return
+		}
+		logrus.WithField("mountpoint", set.Mountpoint).Debug("unfrozen")
+	}, nil
+}
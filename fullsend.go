@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var forceFullEveryFlag = cli.IntFlag{
+	Name:  "force-full-every",
+	Usage: "replace the destination with a full send after this many incremental sends to limit the length of the incremental chain, destinations with child datasets are not replaced, requires --state-dir",
+}
+
+var forceFullIntervalFlag = cli.DurationFlag{
+	Name:  "force-full-interval",
+	Usage: "replace the destination with a full send when the last full send is older than the duration, requires --state-dir",
+}
+
+// fullPolicy schedules full sends replacing the destination even when an
+// incremental send would work
+type fullPolicy struct {
+	state    stateDir
+	every    int
+	interval time.Duration
+}
+
+// fullState counts the incremental sends since the last full send of a
+// dataset to a target
+type fullState struct {
+	Incrementals int       `json:"incrementals"`
+	LastFull     time.Time `json:"last_full"`
+}
+
+func fullStateName(dataset, target string) string {
+	return url.PathEscape(dataset) + "@" + url.PathEscape(target) + ".full.json"
+}
+
+func newFullPolicy(clix *cli.Context, state stateDir) (fullPolicy, error) {
+	p := fullPolicy{
+		state:    state,
+		every:    clix.Int("force-full-every"),
+		interval: clix.Duration("force-full-interval"),
+	}
+	if p.every < 0 || p.interval < 0 {
+		return p, errors.New("--force-full-every and --force-full-interval must not be negative")
+	}
+	if p.enabled() && state == "" {
+		return p, errors.New("--force-full-every and --force-full-interval require --state-dir")
+	}
+	return p, nil
+}
+
+func (p fullPolicy) enabled() bool {
+	return p.every > 0 || p.interval > 0
+}
+
+// due returns true when the next send of the dataset to the target is a
+// scheduled full send. Tracking starts with the first send recorded, a
+// dataset without state is not due.
+func (p fullPolicy) due(dataset, target string, now time.Time) (bool, error) {
+	if !p.enabled() {
+		return false, nil
+	}
+	var s fullState
+	ok, err := p.state.load(fullStateName(dataset, target), &s)
+	if err != nil || !ok {
+		return false, err
+	}
+	if p.every > 0 && s.Incrementals >= p.every {
+		return true, nil
+	}
+	return p.interval > 0 && now.Sub(s.LastFull) >= p.interval, nil
+}
+
+// record counts a successful send of the dataset to the target
+func (p fullPolicy) record(dataset, target string, full bool, now time.Time) error {
+	if !p.enabled() {
+		return nil
+	}
+	var (
+		s    fullState
+		name = fullStateName(dataset, target)
+	)
+	if _, err := p.state.load(name, &s); err != nil {
+		return err
+	}
+	switch {
+	case full:
+		s = fullState{LastFull: now}
+	case s.LastFull.IsZero():
+		// the chain is assumed to start at the first tracked send
+		s = fullState{Incrementals: 1, LastFull: now}
+	default:
+		s.Incrementals++
+	}
+	return p.state.save(name, s)
+}
+
+// destChildren returns the datasets directly under the destination
+func destChildren(h remoteHost, dest string) ([]string, error) {
+	out, err := h.output("list", "-H", "-o", "name", "-d", "1", "-t", "filesystem,volume", dest)
+	if err != nil {
+		return nil, err
+	}
+	var children []string
+	for _, name := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if name != "" && name != dest {
+			children = append(children, name)
+		}
+	}
+	return children, nil
+}
+
+// replaceDest sends the snapshot in full next to the destination then
+// swaps it in, the destination keeps its snapshots until the full send
+// completed. A destination with child datasets is refused, renaming it
+// would move them along and the destroy of the old one destroy them.
+func replaceDest(ctx context.Context, r *remote, dest string, opts sendOpts, set *zfs.Dataset) error {
+	var (
+		h    = remoteHost{ctx: ctx, remote: r}
+		next = dest + ".flux-full"
+		old  = dest + ".flux-old"
+	)
+	children, err := destChildren(h, dest)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return fmt.Errorf("unable to replace %s with a full send, it has the child datasets %s", dest, strings.Join(children, ", "))
+	}
+	logrus.WithFields(logrus.Fields{
+		"snapshot": set.Name,
+		"target":   r.target,
+		"dest":     dest,
+	}).Warn("scheduled full send, the destination is replaced once it completes")
+	// a failed earlier attempt leaves its partial replacement behind
+	if _, err := h.output("list", "-H", "-o", "name", next); err == nil {
+		if _, err := h.output("destroy", "-r", next); err != nil {
+			return err
+		}
+	}
+	if err := send(ctx, r, next, opts, set, nil); err != nil {
+		return err
+	}
+	if _, err := h.output("rename", dest, old); err != nil {
+		return err
+	}
+	if _, err := h.output("rename", next, dest); err != nil {
+		return err
+	}
+	// -r only destroys the snapshots of the old dataset, it has no children
+	_, err = h.output("destroy", "-r", old)
+	return err
+}
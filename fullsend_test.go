@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mistifyio/go-zfs"
+)
+
+func TestReplaceDestWithChildren(t *testing.T) {
+	// the remote runs the command after the target locally
+	fakeCommand(t, "ssh", `while [ "$1" != backup ]; do shift; done
+shift
+exec "$@"
+`)
+	// zfs list -H -o name -d 1 -t filesystem,volume <dest>, any other
+	// command fails the test
+	fakeCommand(t, "zfs", `if [ "$1" != list ]; then
+	echo "unexpected zfs $*" >&2
+	exit 1
+fi
+echo "$9"
+echo "$9/db"
+echo "$9/www"
+`)
+	var (
+		r = &remote{target: "backup", uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+		h = remoteHost{ctx: context.Background(), remote: r}
+	)
+	children, err := destChildren(h, "backup/tank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"backup/tank/db", "backup/tank/www"}; !reflect.DeepEqual(children, want) {
+		t.Errorf("children %v, want %v", children, want)
+	}
+	sent := fakeSend(t)
+	err = replaceDest(context.Background(), r, "backup/tank", sendOpts{}, &zfs.Dataset{Name: "tank@b"})
+	if err == nil || !strings.Contains(err.Error(), "backup/tank/db, backup/tank/www") {
+		t.Errorf("replaced a destination with children: %v", err)
+	}
+	if len(*sent) != 0 {
+		t.Errorf("sent %v", *sent)
+	}
+}
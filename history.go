@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// historyName is the state file holding the transfer history
+const historyName = "transfers.json"
+
+// maxHistory is the number of transfers kept in the history
+const maxHistory = 10000
+
+// historyMu serializes updates of the history from concurrent sends
+var historyMu sync.Mutex
+
+// transferRecord is a completed send to a target
+type transferRecord struct {
+	Time    time.Time `json:"time"`
+	Target  string    `json:"target"`
+	Dataset string    `json:"dataset"`
+	Dest    string    `json:"dest"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// recordTransfer appends the transfer to the history in the state dir
+func recordTransfer(state stateDir, r transferRecord) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	var history []transferRecord
+	if _, err := state.load(historyName, &history); err != nil {
+		logrus.WithError(err).Error("load transfer history")
+		return
+	}
+	history = append(history, r)
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	if err := state.save(historyName, history); err != nil {
+		logrus.WithError(err).Error("save transfer history")
+	}
+}
+
+var reportCommand = cli.Command{
+	Name:  "report",
+	Usage: "summarize the bytes sent per target and day from the transfer history in --state-dir",
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "window,w",
+			Usage: "only include transfers within the window",
+			Value: 30 * Day,
+		},
+		outputFlag,
+	},
+	Action: func(clix *cli.Context) error {
+		if err := validateOutput(clix.String("output")); err != nil {
+			return err
+		}
+		state := stateDir(clix.GlobalString("state-dir"))
+		if state == "" {
+			return errors.New("no --state-dir specified")
+		}
+		var history []transferRecord
+		if _, err := state.load(historyName, &history); err != nil {
+			return err
+		}
+		return render(os.Stdout, clix.String("output"), summarizeTransfers(history, time.Now().Add(-clix.Duration("window"))))
+	},
+}
+
+// transferReport is the volume sent to each target per day
+type transferReport []transferSummary
+
+type transferSummary struct {
+	Day       string `json:"day"`
+	Target    string `json:"target"`
+	Transfers int    `json:"transfers"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// summarizeTransfers totals the transfers since the mark by day and target
+func summarizeTransfers(history []transferRecord, mark time.Time) transferReport {
+	type key struct {
+		day    string
+		target string
+	}
+	var (
+		keys []key
+		sums = make(map[key]*transferSummary)
+	)
+	for _, r := range history {
+		if r.Time.Before(mark) {
+			continue
+		}
+		k := key{day: r.Time.Local().Format("2006-01-02"), target: r.Target}
+		s, ok := sums[k]
+		if !ok {
+			s = &transferSummary{Day: k.day, Target: k.target}
+			sums[k] = s
+			keys = append(keys, k)
+		}
+		s.Transfers++
+		s.Bytes += r.Bytes
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].day != keys[j].day {
+			return keys[i].day < keys[j].day
+		}
+		return keys[i].target < keys[j].target
+	})
+	out := transferReport{}
+	for _, k := range keys {
+		out = append(out, *sums[k])
+	}
+	return out
+}
+
+func (r transferReport) renderText(w io.Writer) error {
+	for _, s := range r {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", s.Day, s.Target, s.Transfers, formatBytes(uint64(s.Bytes))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mistifyio/go-zfs"
+)
+
+// host lists and destroys snapshots on the local machine or a remote
+type host interface {
+	snapshots(name string, opts listOpts) ([]*ExtDataset, error)
+	clones(s *ExtDataset) ([]string, error)
+	holds(s *ExtDataset) ([]string, error)
+	release(s *ExtDataset, tag string) error
+	destroy(s *ExtDataset, flags zfs.DestroyFlag) error
+}
+
+// localhost runs zfs on the local machine, main replaces it with a host
+// whose zfs commands are killed when flux is interrupted
+var localhost host = localHost{ctx: context.Background()}
+
+type localHost struct {
+	ctx context.Context
+}
+
+func (h localHost) snapshots(name string, opts listOpts) ([]*ExtDataset, error) {
+	return getSnapshots(h.ctx, &zfs.Dataset{Name: name}, opts)
+}
+
+func (localHost) clones(s *ExtDataset) ([]string, error) {
+	return getClones(s)
+}
+
+func (h localHost) holds(s *ExtDataset) ([]string, error) {
+	out, err := zfsOutput(h.ctx, "holds", "-H", s.Name)
+	if err != nil {
+		return nil, err
+	}
+	return parseHolds(out), nil
+}
+
+func (h localHost) release(s *ExtDataset, tag string) error {
+	_, err := zfsOutput(h.ctx, "release", tag, s.Name)
+	return err
+}
+
+func (localHost) destroy(s *ExtDataset, flags zfs.DestroyFlag) error {
+	return s.Destroy(flags)
+}
+
+// remoteHost runs zfs on an ssh remote
+type remoteHost struct {
+	ctx    context.Context
+	remote *remote
+}
+
+func (h remoteHost) output(args ...string) ([]byte, error) {
+	out, err := h.remote.zfs(h.ctx, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s zfs %s: %w", h.remote.target, args[0], err)
+	}
+	return out, nil
+}
+
+func (h remoteHost) snapshots(name string, opts listOpts) ([]*ExtDataset, error) {
+	out, err := h.output(snapshotListArgs(name, opts)...)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := parseSnapshots(out)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(snapshotOrders[opts.sortBy](snapshots))
+	return snapshots, nil
+}
+
+func (h remoteHost) clones(s *ExtDataset) ([]string, error) {
+	out, err := h.output("get", "-H", "-o", "value", "clones", s.Name)
+	if err != nil {
+		return nil, err
+	}
+	return splitClones(strings.TrimSpace(string(out))), nil
+}
+
+func (h remoteHost) holds(s *ExtDataset) ([]string, error) {
+	out, err := h.output("holds", "-H", s.Name)
+	if err != nil {
+		return nil, err
+	}
+	return parseHolds(out), nil
+}
+
+func (h remoteHost) release(s *ExtDataset, tag string) error {
+	_, err := h.output("release", tag, s.Name)
+	return err
+}
+
+func (h remoteHost) destroy(s *ExtDataset, flags zfs.DestroyFlag) error {
+	_, err := h.output(append(append([]string{"destroy"}, destroyArgs(flags)...), s.Name)...)
+	return err
+}
+
+// parseHolds returns the hold tags from zfs holds -H
+func parseHolds(out []byte) []string {
+	var tags []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) >= 2 {
+			tags = append(tags, fields[1])
+		}
+	}
+	return tags
+}
+
+// destroyArgs returns the zfs destroy arguments for the flags
+func destroyArgs(flags zfs.DestroyFlag) []string {
+	var args []string
+	if flags&zfs.DestroyRecursive != 0 {
+		args = append(args, "-r")
+	}
+	if flags&zfs.DestroyRecursiveClones != 0 {
+		args = append(args, "-R")
+	}
+	if flags&zfs.DestroyDeferDeletion != 0 {
+		args = append(args, "-d")
+	}
+	if flags&zfs.DestroyForceUmount != 0 {
+		args = append(args, "-f")
+	}
+	return args
+}
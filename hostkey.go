@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// pinnedHostAlias is the name the pinned key is recorded under, ssh looks
+// it up with HostKeyAlias whatever the target is called
+const pinnedHostAlias = "flux-pinned-host"
+
+// keyscanTimeout bounds the key lookup of a target pinned by fingerprint
+const keyscanTimeout = 15 * time.Second
+
+var targetHostKeyFlag = cli.StringFlag{
+	Name:  "target-host-key",
+	Usage: "only connect when the target presents the ssh host key, a known_hosts line, a public key (ssh-ed25519 AAAA...) or its SHA256: fingerprint, ignoring the known_hosts files",
+}
+
+// validateHostKey ensures the pinned host key is a key or a fingerprint
+func validateHostKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	if strings.HasPrefix(key, "SHA256:") {
+		if _, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(key, "SHA256:")); err != nil {
+			return fmt.Errorf("invalid host key fingerprint %q", key)
+		}
+		return nil
+	}
+	if _, _, err := parseHostKey(key); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseHostKey returns the type and the base64 blob of a public key or a
+// known_hosts line
+func parseHostKey(line string) (string, string, error) {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if !isKeyType(fields[i]) {
+			continue
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[i+1]); err != nil {
+			break
+		}
+		return fields[i], fields[i+1], nil
+	}
+	return "", "", fmt.Errorf("invalid host key %q, expected a known_hosts line, a public key or a SHA256: fingerprint", line)
+}
+
+func isKeyType(s string) bool {
+	return strings.HasPrefix(s, "ssh-") || strings.HasPrefix(s, "ecdsa-") || strings.HasPrefix(s, "sk-")
+}
+
+// fingerprint returns the SHA256 fingerprint of the base64 key blob as
+// printed by ssh-keygen -l
+func fingerprint(blob string) string {
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// pinnedKeys are the known_hosts files written for the pinned keys of the
+// targets, removed when flux exits
+var pinnedKeys = struct {
+	sync.Mutex
+	files map[string]string
+	// keep leaves the files for the printed commands using them
+	keep bool
+}{files: make(map[string]string)}
+
+// pinnedKnownHosts returns a known_hosts file holding only the pinned key
+// of the remote's target. The file is empty when the key cannot be resolved
+// so ssh fails closed.
+func pinnedKnownHosts(r *remote) string {
+	pinnedKeys.Lock()
+	defer pinnedKeys.Unlock()
+	id := r.target + "\x00" + r.hostKey
+	if path, ok := pinnedKeys.files[id]; ok {
+		return path
+	}
+	f, err := ioutil.TempFile("", "flux-known-hosts-*")
+	if err != nil {
+		logrus.WithError(err).Error("create known hosts file for the pinned host key")
+		return os.DevNull
+	}
+	defer f.Close()
+	pinnedKeys.files[id] = f.Name()
+	if os.Geteuid() == 0 {
+		// ssh runs as the ssh user and has to read the file
+		if err := f.Chown(int(r.uid), int(r.gid)); err != nil {
+			logrus.WithError(err).Warn("chown known hosts file for the pinned host key")
+		}
+	}
+	keyType, blob, err := resolveHostKey(r.target, r.hostKey)
+	if err != nil {
+		logrus.WithError(err).WithField("target", r.target).Error("resolve pinned host key, connections will fail")
+		return f.Name()
+	}
+	if _, err := fmt.Fprintf(f, "%s %s %s\n", pinnedHostAlias, keyType, blob); err != nil {
+		logrus.WithError(err).Error("write known hosts file for the pinned host key")
+	}
+	return f.Name()
+}
+
+// resolveHostKey returns the pinned key, looking up the key of the target
+// matching a pinned fingerprint with ssh-keyscan
+func resolveHostKey(target, key string) (string, string, error) {
+	if !strings.HasPrefix(key, "SHA256:") {
+		return parseHostKey(key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), keyscanTimeout)
+	defer cancel()
+	host := target[strings.LastIndex(target, "@")+1:]
+	out, err := command(ctx, "ssh-keyscan", "-T", "10", host).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("ssh-keyscan %s: %w", host, err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		keyType, blob, err := parseHostKey(s.Text())
+		if err == nil && fingerprint(blob) == key {
+			return keyType, blob, nil
+		}
+	}
+	return "", "", fmt.Errorf("%s presents no host key with the fingerprint %s", host, key)
+}
+
+// hostKeyArgs returns the ssh options only accepting the pinned key
+func hostKeyArgs(knownHosts string) []string {
+	return []string{
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + knownHosts,
+		"-o", "GlobalKnownHostsFile=" + os.DevNull,
+		"-o", "HostKeyAlias=" + pinnedHostAlias,
+	}
+}
+
+// keepPinnedKeys keeps the known_hosts files of the pinned keys when flux
+// exits
+func keepPinnedKeys() {
+	pinnedKeys.Lock()
+	pinnedKeys.keep = true
+	pinnedKeys.Unlock()
+}
+
+// removePinnedKeys removes the known_hosts files of the pinned keys
+func removePinnedKeys() {
+	pinnedKeys.Lock()
+	defer pinnedKeys.Unlock()
+	for id, path := range pinnedKeys.files {
+		if pinnedKeys.keep {
+			logrus.WithField("path", path).Debug("keeping known hosts file of the pinned host key for the printed commands")
+			continue
+		}
+		os.Remove(path)
+		delete(pinnedKeys.files, id)
+	}
+}
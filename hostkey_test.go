@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyBlob        = "AAAAC3NzaC1lZDI1NTE5AAAAIFFHr3v1rCXeG/B/1o8DyY+yBI3DZfgB1tOycoQwukSQ"
+	testKeyFingerprint = "SHA256:iLmSLh5eCuyfpQ65vwB+oIURRpykYW8GQHW7CPbXSFY"
+)
+
+func TestParseHostKey(t *testing.T) {
+	for _, tc := range []struct {
+		key string
+		ok  bool
+	}{
+		{key: "backup.example.com ssh-ed25519 " + testKeyBlob, ok: true},
+		{key: "backup,10.0.0.2 ssh-ed25519 " + testKeyBlob + " comment", ok: true},
+		{key: "ssh-ed25519 " + testKeyBlob, ok: true},
+		{key: "ssh-ed25519 " + testKeyBlob + " root@backup", ok: true},
+		{key: "ssh-ed25519 not-base64!"},
+		{key: "backup.example.com"},
+		{key: testKeyBlob},
+	} {
+		keyType, blob, err := parseHostKey(tc.key)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: parse error %v", tc.key, err)
+			continue
+		}
+		if tc.ok && (keyType != "ssh-ed25519" || blob != testKeyBlob) {
+			t.Errorf("%q: parsed %s %s", tc.key, keyType, blob)
+		}
+	}
+}
+
+func TestValidateHostKey(t *testing.T) {
+	for _, tc := range []struct {
+		key string
+		ok  bool
+	}{
+		{key: "", ok: true},
+		{key: "backup ssh-ed25519 " + testKeyBlob, ok: true},
+		{key: "ssh-ed25519 " + testKeyBlob, ok: true},
+		{key: testKeyFingerprint, ok: true},
+		{key: "SHA256:not base64"},
+		{key: "MD5:16:27:ac:a5:76:28:2d:36:63:1b:56:4d:eb:df:a6:48"},
+	} {
+		if err := validateHostKey(tc.key); (err == nil) != tc.ok {
+			t.Errorf("%q: validate error %v", tc.key, err)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	if got := fingerprint(testKeyBlob); got != testKeyFingerprint {
+		t.Errorf("fingerprint %s, want %s as printed by ssh-keygen -l", got, testKeyFingerprint)
+	}
+	if got := fingerprint("not base64!"); got != "" {
+		t.Errorf("fingerprint of an invalid blob %s", got)
+	}
+}
+
+func TestPinnedKnownHosts(t *testing.T) {
+	defer removePinnedKeys()
+	for _, key := range []string{
+		"backup ssh-ed25519 " + testKeyBlob,
+		"ssh-ed25519 " + testKeyBlob + " root@backup",
+	} {
+		r := &remote{target: "root@backup", hostKey: key, uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+		path := pinnedKnownHosts(r)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := pinnedHostAlias + " ssh-ed25519 " + testKeyBlob + "\n"; string(data) != want {
+			t.Errorf("%q: known hosts %q, want %q", key, data, want)
+		}
+		if again := pinnedKnownHosts(r); again != path {
+			t.Errorf("%q: wrote a second known hosts file %s", key, again)
+		}
+	}
+}
+
+func TestResolveHostKeyFingerprint(t *testing.T) {
+	// ssh-keyscan prints every key of the host, the one matching is pinned
+	fakeCommand(t, "ssh-keyscan", "echo '# backup:22 SSH-2.0-OpenSSH_9.2'\necho 'backup ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQC7'\necho 'backup ssh-ed25519 "+testKeyBlob+"'\n")
+	keyType, blob, err := resolveHostKey("root@backup", testKeyFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyType != "ssh-ed25519" || blob != testKeyBlob {
+		t.Errorf("resolved %s %s", keyType, blob)
+	}
+	if _, _, err := resolveHostKey("root@backup", "SHA256:"+strings.Repeat("A", 43)); err == nil {
+		t.Error("resolved a fingerprint the host does not present")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var listCommand = cli.Command{
+	Name:      "list",
+	Usage:     "list the snapshots of the datasets grouped by dataset",
+	ArgsUsage: "[dataset...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "after",
+			Usage: "only list snapshots created at or after the RFC3339 time",
+		},
+		cli.StringFlag{
+			Name:  "before",
+			Usage: "only list snapshots created at or before the RFC3339 time",
+		},
+		depthFlag,
+		sortByFlag,
+		datasetFileFlag,
+		datasetRegexFlag,
+		profileFlag,
+		outputFlag,
+	},
+	Action: func(clix *cli.Context) error {
+		if err := validateOutput(clix.String("output")); err != nil {
+			return err
+		}
+		after, err := parseListTime(clix.String("after"), "after")
+		if err != nil {
+			return err
+		}
+		before, err := parseListTime(clix.String("before"), "before")
+		if err != nil {
+			return err
+		}
+		if !after.IsZero() && !before.IsZero() && after.After(before) {
+			return fmt.Errorf("--after %s is later than --before %s", clix.String("after"), clix.String("before"))
+		}
+		entries, err := datasetEntries(clix)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return errors.New("no dataset specified")
+		}
+		re, err := datasetRegex(clix)
+		if err != nil {
+			return err
+		}
+		list, err := newListOpts(clix)
+		if err != nil {
+			return err
+		}
+		report := snapshotList{}
+		for _, e := range matchEntries(entries, re) {
+			snapshots, err := localhost.snapshots(e.Name, list)
+			if err != nil {
+				return err
+			}
+			props, err := snapshotProperties(appContext(clix), e.Name, list)
+			if err != nil {
+				return err
+			}
+			// group by dataset keeping the order within each
+			sort.SliceStable(snapshots, func(i, j int) bool {
+				return snapshots[i].BaseName < snapshots[j].BaseName
+			})
+			for _, s := range snapshots {
+				if (!after.IsZero() && s.Created.Before(after)) || (!before.IsZero() && s.Created.After(before)) {
+					continue
+				}
+				report = append(report, listedSnapshot{
+					Dataset:  s.BaseName,
+					Snapshot: s.Name,
+					Created:  displayTime(s.Created),
+					Used:     s.Used,
+					Props:    props[s.Name],
+				})
+			}
+		}
+		return render(os.Stdout, clix.String("output"), report)
+	},
+}
+
+// parseListTime parses the RFC3339 time of the flag, zero when not set
+func parseListTime(v, flag string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("--%s: %w", flag, err)
+	}
+	return t, nil
+}
+
+// snapshotList are the listed snapshots in the order of their datasets
+type snapshotList []listedSnapshot
+
+type listedSnapshot struct {
+	Dataset  string    `json:"dataset"`
+	Snapshot string    `json:"snapshot"`
+	Created  time.Time `json:"created"`
+	Used     uint64    `json:"used"`
+	// Props are the user properties set on the snapshot, such as the
+	// --snapshot-property of the snapshot command
+	Props map[string]string `json:"properties,omitempty"`
+}
+
+func (l snapshotList) renderText(w io.Writer) error {
+	var (
+		now     = time.Now()
+		dataset string
+	)
+	for i, s := range l {
+		if i == 0 || s.Dataset != dataset {
+			dataset = s.Dataset
+			if _, err := fmt.Fprintf(w, "%s\n", dataset); err != nil {
+				return err
+			}
+		}
+		line := fmt.Sprintf("  %s\t%s (%s)\t%s", shortName(s.Snapshot), formatTime(s.Created), formatAge(now, s.Created), formatBytes(s.Used))
+		if len(s.Props) > 0 {
+			line += "\t" + formatProps(s.Props)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotProperties returns the user properties of the snapshots of name
+// by snapshot, walking the tree like the listing. Only user properties can
+// be set on snapshots so the local ones are read, without the flux:
+// properties flux keeps for itself.
+func snapshotProperties(ctx context.Context, name string, list listOpts) (map[string]map[string]string, error) {
+	args := []string{"get", "-H", "-p", "-s", "local", "-o", "name,property,value", "-t", TypeSnapshot}
+	args = append(args, depthArgs(list.depth)...)
+	out, err := zfsOutput(ctx, append(args, "all", name)...)
+	if err != nil {
+		return nil, err
+	}
+	props := make(map[string]map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 || strings.HasPrefix(fields[1], "flux:") {
+			continue
+		}
+		if props[fields[0]] == nil {
+			props[fields[0]] = make(map[string]string)
+		}
+		props[fields[0]][fields[1]] = fields[2]
+	}
+	return props, nil
+}
+
+// formatProps returns the properties as property=value pairs sorted by name
+func formatProps(props map[string]string) string {
+	pairs := make([]string, 0, len(props))
+	for k, v := range props {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
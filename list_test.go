@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotProperties(t *testing.T) {
+	fakeCommand(t, "zfs", `echo "$@" > "$ARGS"
+printf 'tank/home@a\tbackup:class\tgold\n'
+printf 'tank/home@a\tflux:created\t1760400000\n'
+printf 'tank/home@a\tapp:version\t1.2 beta\n'
+printf 'tank/home/db@a\tbackup:class\tsilver\n'
+`)
+	args := t.TempDir() + "/args"
+	t.Setenv("ARGS", args)
+	props, err := snapshotProperties(context.Background(), "tank/home", listOpts{depth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		"tank/home@a":    {"backup:class": "gold", "app:version": "1.2 beta"},
+		"tank/home/db@a": {"backup:class": "silver"},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("properties %v, want %v", props, want)
+	}
+	if got := formatProps(props["tank/home@a"]); got != "app:version=1.2 beta backup:class=gold" {
+		t.Errorf("formatted %q", got)
+	}
+	out, err := ioutil.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); got != "get -H -p -s local -o name,property,value -t snapshot -d 2 all tank/home\n" {
+		t.Errorf("zfs %s", got)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/syslog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// setupLogging sends the logs to a file or syslog instead of stderr
+func setupLogging(clix *cli.Context) error {
+	if path := clix.GlobalString("log-file"); path != "" {
+		f, err := openLogFile(path)
+		if err != nil {
+			return err
+		}
+		logrus.SetOutput(f)
+		// reopen the file on SIGHUP after logrotate moves it away
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := f.reopen(); err != nil {
+					logrus.WithError(err).Error("reopen log file")
+				}
+			}
+		}()
+	}
+	if clix.GlobalBool("syslog") {
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "flux")
+		if err != nil {
+			return err
+		}
+		logrus.AddHook(&syslogHook{
+			w: w,
+		})
+	}
+	return nil
+}
+
+// logFile is a log file that can be reopened
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{
+		path: path,
+	}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// syslogHook writes log entries to syslog at their level
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return h.w.Crit(line)
+	case logrus.ErrorLevel:
+		return h.w.Err(line)
+	case logrus.WarnLevel:
+		return h.w.Warning(line)
+	case logrus.InfoLevel:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
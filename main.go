@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,218 +31,325 @@ func main() {
 			Name:  "debug",
 			Usage: "enable debug output in the logs",
 		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Usage: "directory to keep state between runs, enables resumable sends",
+		},
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "write logs to the file instead of stderr, reopened on SIGHUP",
+		},
+		cli.BoolFlag{
+			Name:  "syslog",
+			Usage: "also send logs to syslog",
+		},
+		cli.DurationFlag{
+			Name:  "max-runtime",
+			Usage: "abort the command and its zfs and ssh processes once it runs longer than the duration, exiting with 124",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the actions of any command without changing anything",
+		},
+		nameSeparatorFlag,
+		cli.StringFlag{
+			Name:  "tz",
+			Usage: "time zone of the displayed times (UTC, Europe/Paris), defaults to the local time zone",
+		},
 	}
 	app.Commands = []cli.Command{
 		snapshotCommand,
 		purgeCommand,
+		purgeDestCommand,
+		verifyChainCommand,
+		rollbackCommand,
+		analyzeCommand,
+		sendCommand,
+		verifyStreamCommand,
+		reportCommand,
+		runCommand,
+		browseCommand,
+		validateCommand,
+		promoteCommand,
+		listCommand,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.Metadata = map[string]interface{}{
+		"context": ctx,
 	}
+	localhost = localHost{ctx: ctx}
+	// exceeded is closed when --max-runtime aborts the command
+	var (
+		maxRuntime time.Duration
+		exceeded   = make(chan struct{})
+	)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		logrus.WithField("signal", s).Warn("interrupted, aborting")
+		cancel()
+	}()
 	app.Before = func(clix *cli.Context) error {
 		if clix.GlobalBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
-		return nil
-	}
-	if err := app.Run(os.Args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-}
-
-const (
-	Day          = 24 * time.Hour
-	Week         = 7 * Day
-	TypeSnapshot = "snapshot"
-)
-
-var purgeCommand = cli.Command{
-	Name:  "purge",
-	Usage: "purge old snapshots",
-	Flags: []cli.Flag{
-		cli.DurationFlag{
-			Name:  "older-than,o",
-			Usage: "purge snapshots older than",
-			Value: 2 * Week,
-		},
-		cli.BoolFlag{
-			Name:  "dry",
-			Usage: "display don't delete",
-		},
-	},
-	Action: func(clix *cli.Context) error {
-		mark := time.Now().Add(-clix.Duration("older-than"))
-		data, err := zfs.GetDataset("tank")
-		if err != nil {
+		if err := setupLogging(clix); err != nil {
 			return err
 		}
-		sets, err := data.Children(0)
-		if err != nil {
+		if err := validateSeparator(clix.GlobalString("name-separator")); err != nil {
 			return err
 		}
-		for _, d := range sets {
-			if d.Type != TypeSnapshot {
-				continue
-			}
-			created, err := getCreationTime(d)
+		nameSeparator = clix.GlobalString("name-separator")
+		if tz := clix.GlobalString("tz"); tz != "" {
+			loc, err := time.LoadLocation(tz)
 			if err != nil {
-				logrus.WithError(err).Error("get creation time")
-				continue
-			}
-			if created.Before(mark) {
-				logrus.Debugf("destory %s", d.Name)
-				if !clix.Bool("dry") {
-					if err := d.Destroy(zfs.DestroyDefault); err != nil {
-						logrus.WithError(err).Error("unable destroy")
-					}
-				}
+				return fmt.Errorf("--tz: %w", err)
 			}
+			displayLocation = loc
+		}
+		if clix.GlobalBool("dry-run") {
+			logrus.Warn("DRY RUN, no changes are made")
+		}
+		if maxRuntime = clix.GlobalDuration("max-runtime"); maxRuntime > 0 {
+			time.AfterFunc(maxRuntime, func() {
+				logrus.WithField("max-runtime", maxRuntime).Warn("max runtime exceeded, aborting")
+				close(exceeded)
+				cancel()
+			})
 		}
 		return nil
-	},
+	}
+	err := app.Run(os.Args)
+	removePinnedKeys()
+	if err != nil {
+		select {
+		case <-exceeded:
+			err = maxRuntimeError{limit: maxRuntime, err: err}
+		default:
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(ctx, err))
+	}
 }
 
-const creationProp = "creation"
+// appContext returns the context that is canceled when flux is interrupted
+func appContext(clix *cli.Context) context.Context {
+	return clix.App.Metadata["context"].(context.Context)
+}
 
-func getCreationTime(d *zfs.Dataset) (time.Time, error) {
-	p, err := d.GetProperty(creationProp)
-	if err != nil {
-		return time.Time{}, err
+// dryRun returns true if the command only displays its actions, either
+// with its own --dry or the global --dry-run
+func dryRun(clix *cli.Context) bool {
+	return clix.Bool("dry") || clix.GlobalBool("dry-run")
+}
+
+// command returns a cmd in its own process group that is killed,
+// along with the group, when ctx is canceled
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
 	}
-	v, err := strconv.Atoi(p)
-	if err != nil {
-		return time.Time{}, err
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
-	return time.Unix(int64(v), 0), nil
+	return cmd
 }
 
-var snapshotCommand = cli.Command{
-	Name:  "snapshot",
-	Usage: "snapshot",
-	Flags: []cli.Flag{
-		cli.StringFlag{
-			Name:  "send,s",
-			Usage: "send to an ssh target",
-		},
-		cli.StringFlag{
-			Name:  "dest,d",
-			Usage: "destination",
-		},
-		cli.UintFlag{
-			Name:  "uid",
-			Usage: "ssh user",
-		},
-		cli.UintFlag{
-			Name:  "gid",
-			Usage: "ssh group",
-		},
-		cli.BoolFlag{
-			Name:  "init",
-			Usage: "send the inital snapshot",
-		},
-	},
-	Action: func(clix *cli.Context) error {
-		var (
-			now    = time.Now()
-			names  = clix.Args()
-			target = clix.String("send")
-			dest   = clix.String("dest")
-			initS  = clix.Bool("init")
-		)
-		for _, name := range names {
-			set, err := zfs.GetDataset(name)
-			if err != nil {
-				return err
-			}
-			snapshots, err := getSnapshots(set)
-			if err != nil {
-				return err
-			}
-			prev := snapshots[len(snapshots)-1]
-			if initS {
-				prev = nil
-			}
+const (
+	Day          = 24 * time.Hour
+	Week         = 7 * Day
+	TypeSnapshot = "snapshot"
+	TypeBookmark = "bookmark"
+)
 
-			snapshot, err := set.Snapshot(now.Format(time.RFC3339), false)
-			if err != nil {
-				return err
-			}
+var depthFlag = cli.IntFlag{
+	Name:  "depth",
+	Usage: "depth of the dataset tree to walk for snapshots, -1 for full recursion",
+	Value: -1,
+}
 
-			if target != "" {
-				if dest == "" {
-					return errors.New("no dest specified")
-				}
-				if err := send(target, dest, uint32(clix.Uint("uid")), uint32(clix.Uint("gid")), snapshot, prev); err != nil {
-					return err
-				}
-			}
-		}
-		return nil
-	},
+var sortByFlag = cli.StringFlag{
+	Name:  "sort-by",
+	Usage: "order snapshots by creation or by the timestamp in their name, falling back to creation",
+	Value: "creation",
 }
 
-func send(target, dest string, uid, gid uint32, set *zfs.Dataset, prev *ExtDataset) error {
-	ssh := sshSend(target, dest)
-	ssh.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid: uid,
-			Gid: gid,
-		},
-	}
-	in, err := ssh.StdinPipe()
-	if err != nil {
-		return err
-	}
-	defer in.Close()
+// listOpts control how snapshots are listed
+type listOpts struct {
+	depth  int
+	sortBy string
+}
 
-	ssh.Stderr = os.Stderr
-	ssh.Stdout = os.Stdout
-	if err := ssh.Start(); err != nil {
-		return err
-	}
-	if prev == nil {
-		if err := set.SendSnapshot(in); err != nil {
-			return err
-		}
-		return ssh.Wait()
+func newListOpts(clix *cli.Context) (listOpts, error) {
+	opts := listOpts{
+		depth:  clix.Int("depth"),
+		sortBy: clix.String("sort-by"),
 	}
-	if err := set.IncrementalSend(prev.Dataset, in); err != nil {
-		return err
+	if _, ok := snapshotOrders[opts.sortBy]; !ok {
+		return opts, fmt.Errorf("unknown sort order %q", opts.sortBy)
 	}
-	return ssh.Wait()
-}
-
-func sshSend(target, dest string) *exec.Cmd {
-	return exec.Command("ssh", target, "zfs", "recv", dest)
+	return opts, nil
 }
 
 type ExtDataset struct {
 	*zfs.Dataset
 	BaseName string
 	Created  time.Time
+	// CreateTXG is the transaction group the snapshot was created in,
+	// it orders snapshots created within the same second
+	CreateTXG uint64
+	// GUID identifies the snapshot across renames and hosts, a received
+	// snapshot keeps the guid of the sent one
+	GUID  uint64
+	Label string
+	// NameTime is the timestamp in the snapshot name, zero if the name has none
+	NameTime time.Time
+	// Managed is true when the snapshot is named by flux
+	Managed bool
+	// Clones are the datasets cloned from the snapshot when it was listed
+	Clones []string
 }
 
-func getSnapshots(set *zfs.Dataset) ([]*ExtDataset, error) {
-	sets, err := set.Children(0)
+// snapshotProps are the properties read for every snapshot in a single zfs list
+var snapshotProps = []string{"name", "creation", "used", "type", "written", "createtxg", "guid", "clones"}
+
+func getSnapshots(ctx context.Context, set *zfs.Dataset, opts listOpts) ([]*ExtDataset, error) {
+	out, err := zfsOutput(ctx, snapshotListArgs(set.Name, opts)...)
 	if err != nil {
 		return nil, err
 	}
-	var out []*ExtDataset
-	for _, s := range sets {
-		if s.Type == TypeSnapshot {
-			created, err := getCreationTime(s)
-			if err != nil {
-				continue
-			}
-			out = append(out, &ExtDataset{
-				Dataset:  s,
-				BaseName: strings.Split(s.Name, "@")[0],
-				Created:  created,
-			})
+	snapshots, err := parseSnapshots(out)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(snapshotOrders[opts.sortBy](snapshots))
+	return snapshots, nil
+}
+
+// snapshotListArgs returns the zfs list arguments to list the snapshots of name
+func snapshotListArgs(name string, opts listOpts) []string {
+	args := []string{"list", "-H", "-p", "-t", TypeSnapshot, "-o", strings.Join(snapshotProps, ",")}
+	args = append(args, depthArgs(opts.depth)...)
+	return append(args, name)
+}
+
+// parseSnapshots parses the snapshotProps columns of zfs list
+func parseSnapshots(out []byte) ([]*ExtDataset, error) {
+	var (
+		snapshots []*ExtDataset
+		s         = bufio.NewScanner(bytes.NewReader(out))
+	)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != len(snapshotProps) {
+			return nil, fmt.Errorf("unexpected zfs list output %q", s.Text())
+		}
+		// snapshotListArgs only lists snapshots, bookmarks are listed by
+		// listBookmarks
+		if fields[3] != TypeSnapshot {
+			continue
+		}
+		created, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			logrus.WithError(err).WithField("snapshot", fields[0]).Debug("parse creation time")
+			continue
+		}
+		used, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		written, err := strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return nil, err
 		}
+		txg, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		guid, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		label, nameTime, managed := parseSnapshotName(fields[0])
+		if !managed {
+			logrus.WithField("snapshot", fields[0]).Debug("snapshot not created by flux")
+		}
+		snapshots = append(snapshots, &ExtDataset{
+			Dataset: &zfs.Dataset{
+				Name:    fields[0],
+				Type:    fields[3],
+				Used:    used,
+				Written: written,
+			},
+			BaseName:  baseName(fields[0]),
+			Created:   time.Unix(created, 0),
+			CreateTXG: txg,
+			GUID:      guid,
+			Label:     label,
+			NameTime:  nameTime,
+			Managed:   managed,
+			Clones:    splitClones(fields[7]),
+		})
+	}
+	return snapshots, s.Err()
+}
+
+// zfsOutput runs zfs with args returning its output, or its stderr on
+// failure. zfs is killed when ctx is canceled.
+func zfsOutput(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := command(ctx, "zfs", args...).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && len(exit.Stderr) > 0 {
+			return nil, fmt.Errorf("zfs %s: %s", args[0], strings.TrimSpace(string(exit.Stderr)))
+		}
+		return nil, err
 	}
-	sort.Sort(byCreated(out))
 	return out, nil
 }
 
+// snapshotID returns the identity of the snapshot to match snapshots between
+// a source and a destination, the guid or the name after the @ without one
+func snapshotID(s *ExtDataset) string {
+	if s.GUID == 0 {
+		return "@" + shortName(s.Name)
+	}
+	return strconv.FormatUint(s.GUID, 10)
+}
+
+// ownSnapshots returns the snapshots of the dataset itself, without the
+// snapshots of its children
+func ownSnapshots(snapshots []*ExtDataset, name string) []*ExtDataset {
+	var own []*ExtDataset
+	for _, s := range snapshots {
+		if s.BaseName == name {
+			own = append(own, s)
+		}
+	}
+	return own
+}
+
+// newestLabeled returns the newest snapshot with the label
+func newestLabeled(snapshots []*ExtDataset, label string) *ExtDataset {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Label == label {
+			return snapshots[i]
+		}
+	}
+	return nil
+}
+
+// depthArgs returns the zfs list arguments to walk the tree down to depth,
+// a depth less than 1 walks the full tree
+func depthArgs(depth int) []string {
+	if depth < 1 {
+		return []string{"-r"}
+	}
+	return []string{"-d", strconv.Itoa(depth)}
+}
+
 var errNoTime = errors.New("no time specified")
 
 type byCreated []*ExtDataset
@@ -251,5 +363,85 @@ func (s byCreated) Swap(i, j int) {
 }
 
 func (s byCreated) Less(i, j int) bool {
+	if s[i].Created.Equal(s[j].Created) {
+		return s[i].CreateTXG < s[j].CreateTXG
+	}
 	return s[i].Created.Before(s[j].Created)
 }
+
+// byName orders snapshots by the timestamp in their name, using the
+// creation time for snapshots whose name has no timestamp
+type byName []*ExtDataset
+
+func (s byName) Len() int {
+	return len(s)
+}
+
+func (s byName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byName) Less(i, j int) bool {
+	a, b := nameOrCreated(s[i]), nameOrCreated(s[j])
+	if a.Equal(b) {
+		return s[i].CreateTXG < s[j].CreateTXG
+	}
+	return a.Before(b)
+}
+
+func nameOrCreated(s *ExtDataset) time.Time {
+	if s.NameTime.IsZero() {
+		return s.Created
+	}
+	return s.NameTime
+}
+
+// snapshotOrders are the orders snapshots can be sorted in by --sort-by
+var snapshotOrders = map[string]func([]*ExtDataset) sort.Interface{
+	"creation": func(s []*ExtDataset) sort.Interface { return byCreated(s) },
+	"name":     func(s []*ExtDataset) sort.Interface { return byName(s) },
+}
+
+// snapshotCache caches snapshot listings for a single command invocation
+type snapshotCache struct {
+	mu       sync.Mutex
+	listings map[snapshotCacheKey][]*ExtDataset
+}
+
+type snapshotCacheKey struct {
+	name string
+	opts listOpts
+}
+
+func newSnapshotCache() *snapshotCache {
+	return &snapshotCache{
+		listings: make(map[snapshotCacheKey][]*ExtDataset),
+	}
+}
+
+// get returns the snapshots of set, listing them only once
+func (c *snapshotCache) get(ctx context.Context, set *zfs.Dataset, opts listOpts) ([]*ExtDataset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := snapshotCacheKey{name: set.Name, opts: opts}
+	if snapshots, ok := c.listings[key]; ok {
+		return snapshots, nil
+	}
+	snapshots, err := getSnapshots(ctx, set, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.listings[key] = snapshots
+	return snapshots, nil
+}
+
+// invalidate drops the listings that include snapshots of the dataset
+func (c *snapshotCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.listings {
+		if key.name == name || strings.HasPrefix(name, key.name+"/") {
+			delete(c.listings, key)
+		}
+	}
+}
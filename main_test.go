@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSnapshots(t *testing.T) {
+	out := strings.Join([]string{
+		"tank/home@daily-2026-10-13T00:00:00Z\t1760313600\t1024\tsnapshot\t4096\t100\t11\t-",
+		"tank/home@daily-2026-10-14T00:00:00Z\t1760400000\t0\tsnapshot\t2048\t110\t12\t",
+		"tank/home@release-1.2.3\t1760400060\t512\tsnapshot\t0\t111\t13\ttank/test,tank/ci/build",
+		"tank/home/db@daily-2026-10-14T00:00:00Z\t1760400000\t8192\tsnapshot\t8192\t110\t14\ttank/db-clone",
+	}, "\n") + "\n"
+	snapshots, err := parseSnapshots([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type parsed struct {
+		name     string
+		base     string
+		created  int64
+		used     uint64
+		written  uint64
+		txg      uint64
+		guid     uint64
+		label    string
+		managed  bool
+		nameTime time.Time
+		clones   []string
+	}
+	want := []parsed{
+		{"tank/home@daily-2026-10-13T00:00:00Z", "tank/home", 1760313600, 1024, 4096, 100, 11, "daily", true, time.Date(2026, 10, 13, 0, 0, 0, 0, time.UTC), nil},
+		{"tank/home@daily-2026-10-14T00:00:00Z", "tank/home", 1760400000, 0, 2048, 110, 12, "daily", true, time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), nil},
+		{"tank/home@release-1.2.3", "tank/home", 1760400060, 512, 0, 111, 13, "", false, time.Time{}, []string{"tank/test", "tank/ci/build"}},
+		{"tank/home/db@daily-2026-10-14T00:00:00Z", "tank/home/db", 1760400000, 8192, 8192, 110, 14, "daily", true, time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), []string{"tank/db-clone"}},
+	}
+	if len(snapshots) != len(want) {
+		t.Fatalf("parsed %d snapshots, want %d", len(snapshots), len(want))
+	}
+	for i, s := range snapshots {
+		got := parsed{s.Name, s.BaseName, s.Created.Unix(), s.Used, s.Written, s.CreateTXG, s.GUID, s.Label, s.Managed, s.NameTime, s.Clones}
+		if !got.nameTime.Equal(want[i].nameTime) {
+			t.Errorf("%s: name time %s, want %s", s.Name, got.nameTime, want[i].nameTime)
+		}
+		got.nameTime = want[i].nameTime
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("parsed %+v, want %+v", got, want[i])
+		}
+		if s.Type != TypeSnapshot {
+			t.Errorf("%s: type %s", s.Name, s.Type)
+		}
+	}
+}
+
+func TestParseSnapshotsInvalid(t *testing.T) {
+	for _, out := range []string{
+		// a column missing
+		"tank/home@a\t1760313600\t1024\tsnapshot\t4096\t100\t11\n",
+		"tank/home@a\t1760313600\tnone\tsnapshot\t4096\t100\t11\t-\n",
+		"tank/home@a\t1760313600\t1024\tsnapshot\t4096\t100\tguid\t-\n",
+	} {
+		if _, err := parseSnapshots([]byte(out)); err == nil {
+			t.Errorf("parsed %q", out)
+		}
+	}
+	// snapshots without a creation time are left out
+	snapshots, err := parseSnapshots([]byte("tank/home@a\t-\t1024\tsnapshot\t4096\t100\t11\t-\n"))
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("parsed %v %v", snapshots, err)
+	}
+}
+
+func TestSnapshotListArgs(t *testing.T) {
+	list := []string{"list", "-H", "-p", "-t", "snapshot", "-o", "name,creation,used,type,written,createtxg,guid,clones"}
+	for _, tc := range []struct {
+		name  string
+		depth int
+		want  []string
+	}{
+		// the zero value of --depth walks the full tree
+		{name: "depth 0", depth: 0, want: []string{"-r"}},
+		{name: "full recursion", depth: -1, want: []string{"-r"}},
+		{name: "depth 1", depth: 1, want: []string{"-d", "1"}},
+		{name: "depth 3", depth: 3, want: []string{"-d", "3"}},
+	} {
+		if got := depthArgs(tc.depth); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: depth args %q, want %q", tc.name, got, tc.want)
+		}
+		want := append(append(append([]string{}, list...), tc.want...), "tank/home")
+		if got := snapshotListArgs("tank/home", listOpts{depth: tc.depth}); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: list args %q, want %q", tc.name, got, want)
+		}
+	}
+}
+
+func BenchmarkParseSnapshots(b *testing.B) {
+	var (
+		buf   bytes.Buffer
+		start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+	// hourly snapshots of a hundred datasets over a month
+	for d := 0; d < 100; d++ {
+		for h := 0; h < 24*30; h++ {
+			at := start.Add(time.Duration(h) * time.Hour)
+			fmt.Fprintf(&buf, "tank/home/user%d@%s\t%d\t1024\tsnapshot\t4096\t%d\t%d\t-\n",
+				d, snapshotName("hourly", at), at.Unix(), h, d*10000+h)
+		}
+	}
+	out := buf.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseSnapshots(out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
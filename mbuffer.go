@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// mbufferDialTimeout bounds the wait for the remote listener to accept
+const mbufferDialTimeout = 30 * time.Second
+
+var mbufferPortFlag = cli.IntFlag{
+	Name:  "mbuffer-port",
+	Usage: "stream over plain tcp to an mbuffer started on the target listening on the port instead of through ssh, the stream is NOT encrypted, only use on trusted networks",
+}
+
+var mbufferAddrFlag = cli.StringFlag{
+	Name:  "mbuffer-addr",
+	Usage: "address of the target the stream connects to with --mbuffer-port, defaults to the host of the ssh target",
+}
+
+// mbuffer streams to an mbuffer listener on the remote that feeds the
+// recv, ssh only starts the listener. Without ssh the stream skips the
+// encryption overhead, it is readable and can be tampered with by anyone
+// on the network path.
+type mbuffer struct {
+	r    *remote
+	addr string
+	port int
+}
+
+// newMbuffer returns the mbuffer transport to the remote, or the remote
+// itself when mbuffer is not installed on it
+func newMbuffer(ctx context.Context, r *remote, addr string, port int) transport {
+	if err := r.command(ctx, "command", "-v", "mbuffer").Run(); err != nil {
+		logrus.WithField("target", r.target).Warn("mbuffer is not installed on the target, sending over ssh")
+		return r
+	}
+	return &mbuffer{
+		r:    r,
+		addr: mbufferHost(r, addr),
+		port: port,
+	}
+}
+
+// mbufferHost returns the address the stream connects to, the host of the
+// ssh target by default
+func mbufferHost(r *remote, addr string) string {
+	if addr == "" {
+		return r.target[strings.LastIndex(r.target, "@")+1:]
+	}
+	return addr
+}
+
+// listenerArgs returns the ssh arguments starting the listener feeding
+// the recv
+func (m *mbuffer) listenerArgs(recvArgs []string) []string {
+	return []string{m.r.target, fmt.Sprintf("mbuffer -q -m 1G -I %d | %s", m.port, m.r.recvLine(recvArgs))}
+}
+
+// pipeline returns the shell commands equivalent to the transport, the
+// listener runs in the background while mbuffer sends the stream to it
+func (m *mbuffer) pipeline(send string, recvArgs []string) string {
+	return m.r.sshLine(m.listenerArgs(recvArgs)...) + " & " + send + " | " + shellJoin([]string{"mbuffer", "-q", "-O", net.JoinHostPort(m.addr, strconv.Itoa(m.port))})
+}
+
+func (m *mbuffer) String() string {
+	return m.r.String()
+}
+
+// start starts the listener over ssh and connects the stream to it
+func (m *mbuffer) start(ctx context.Context, recvArgs []string) (io.WriteCloser, func() error, error) {
+	listener := m.r.ssh(ctx, m.listenerArgs(recvArgs)...)
+	listener.Stderr = os.Stderr
+	listener.Stdout = os.Stdout
+	if err := listener.Start(); err != nil {
+		return nil, nil, err
+	}
+	conn, err := dialListener(ctx, net.JoinHostPort(m.addr, strconv.Itoa(m.port)))
+	if err != nil {
+		listener.Process.Kill()
+		listener.Wait()
+		return nil, nil, err
+	}
+	logrus.WithField("addr", conn.RemoteAddr()).Debug("streaming to mbuffer")
+	return conn, listener.Wait, nil
+}
+
+// dialListener connects to the listener, retrying while it starts. Only
+// the connection carrying the stream is made, mbuffer accepts a single one.
+func dialListener(ctx context.Context, addr string) (net.Conn, error) {
+	var (
+		d        net.Dialer
+		deadline = time.Now().Add(mbufferDialTimeout)
+	)
+	for {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("connect to mbuffer on %s: %w", addr, err)
+		}
+		if err := waitUntil(ctx, time.Now().Add(250*time.Millisecond)); err != nil {
+			return nil, err
+		}
+	}
+}
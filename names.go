@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// labelProp stores the label of a snapshot created by flux
+const labelProp = "flux:label"
+
+// createdProp stores the time a snapshot with an explicit name was created
+// by flux, its name carries no timestamp
+const createdProp = "flux:created"
+
+// lastSentProp stores on a dataset the name after the @ of its snapshot
+// last sent successfully
+const lastSentProp = "flux:last-sent"
+
+// validUserProp matches zfs user property names, they need a colon to not
+// clash with native properties
+var validUserProp = regexp.MustCompile(`^[a-z0-9_.-]+:[a-z0-9_.:-]*$`)
+
+// validateUserProp ensures the property=value sets a user property
+func validateUserProp(p string) error {
+	kv := strings.SplitN(p, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("invalid property %q, expected property=value", p)
+	}
+	if len(kv[0]) > 256 || !validUserProp.MatchString(kv[0]) {
+		return fmt.Errorf("invalid user property name %q, expected module:property", kv[0])
+	}
+	return nil
+}
+
+var labelFlag = cli.StringFlag{
+	Name:  "label,l",
+	Usage: "label prefixing snapshot names so schedules only manage their own snapshots",
+}
+
+var validLabel = regexp.MustCompile(`^[A-Za-z0-9_.:-]*$`)
+
+// invalidNameChars matches the characters zfs does not allow in snapshot
+// names
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+func validateLabel(label string) error {
+	if !validLabel.MatchString(label) {
+		return fmt.Errorf("invalid label %q, only letters, digits and _.:- are allowed, such as %q", label, sanitizeLabel(label))
+	}
+	return nil
+}
+
+// sanitizeLabel replaces the characters not allowed in snapshot names,
+// such as spaces and slashes, with underscores
+func sanitizeLabel(label string) string {
+	return invalidNameChars.ReplaceAllString(label, "_")
+}
+
+var validSnapshotName = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// maxNameLen is the longest full snapshot name zfs accepts
+const maxNameLen = 255
+
+func validateSnapshotName(name string) error {
+	if !validSnapshotName.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// validateFullName ensures zfs accepts the snapshot of the dataset before
+// it is taken
+func validateFullName(dataset, name string) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	if full := dataset + "@" + name; len(full) > maxNameLen {
+		return fmt.Errorf("snapshot name %s is longer than %d characters", full, maxNameLen)
+	}
+	return nil
+}
+
+// nameSeparator separates the label from the time in snapshot names, set
+// by the global --name-separator
+var nameSeparator = "-"
+
+var nameSeparatorFlag = cli.StringFlag{
+	Name:  "name-separator",
+	Usage: "separator between the label and the time in snapshot names, one of - _ . :, existing snapshots are only recognized with the separator they were named with",
+	Value: "-",
+}
+
+func validateSeparator(sep string) error {
+	switch sep {
+	case "-", "_", ".", ":":
+		return nil
+	}
+	return fmt.Errorf("invalid name separator %q, use one of - _ . :", sep)
+}
+
+// snapshotName returns the name for a snapshot taken at t with the label.
+// The time is in UTC, zfs does not allow the + of positive offsets.
+func snapshotName(label string, t time.Time) string {
+	name := t.UTC().Format(time.RFC3339)
+	if label == "" {
+		return name
+	}
+	return label + nameSeparator + name
+}
+
+// preciseSnapshotName returns the name for a snapshot taken at t with the
+// nanoseconds, used when another snapshot already took the name of the second
+func preciseSnapshotName(label string, t time.Time) string {
+	name := t.UTC().Format(time.RFC3339Nano)
+	if label == "" {
+		return name
+	}
+	return label + nameSeparator + name
+}
+
+// parseSnapshotName returns the label and time of a snapshot named by flux,
+// names from before they were in UTC carry the offset of their zone
+func parseSnapshotName(name string) (string, time.Time, bool) {
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[i+1:]
+	}
+	if t, err := time.Parse(time.RFC3339, name); err == nil {
+		return "", t, true
+	}
+	for i := range name {
+		if !strings.HasPrefix(name[i:], nameSeparator) {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, name[i+len(nameSeparator):]); err == nil {
+			return name[:i], t, true
+		}
+	}
+	return "", time.Time{}, false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotNameValid(t *testing.T) {
+	for _, zone := range []*time.Location{
+		time.UTC,
+		time.FixedZone("CEST", 2*60*60),
+		time.FixedZone("EST", -5*60*60),
+	} {
+		at := time.Date(2026, 10, 14, 16, 42, 9, 123456789, zone)
+		for _, name := range []string{
+			snapshotName("daily", at),
+			preciseSnapshotName("daily", at),
+			snapshotName("", at),
+		} {
+			if err := validateSnapshotName(name); err != nil {
+				t.Errorf("%s: %v", zone, err)
+			}
+			_, parsed, ok := parseSnapshotName("tank/home@" + name)
+			if !ok {
+				t.Errorf("%s: unable to parse %s", zone, name)
+				continue
+			}
+			if !parsed.Equal(at.Truncate(time.Second)) && !parsed.Equal(at) {
+				t.Errorf("%s: parsed %s from %s, want %s", zone, parsed, name, at)
+			}
+		}
+	}
+	if got, want := snapshotName("daily", time.Date(2026, 10, 14, 16, 42, 9, 0, time.FixedZone("CEST", 2*60*60))), "daily-2026-10-14T14:42:09Z"; got != want {
+		t.Errorf("named %s, want %s", got, want)
+	}
+}
+
+func TestParseSnapshotName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		label string
+		at    string
+		ok    bool
+	}{
+		{name: "tank@2026-10-14T14:42:09Z", at: "2026-10-14T14:42:09Z", ok: true},
+		{name: "tank@daily-2026-10-14T14:42:09Z", label: "daily", at: "2026-10-14T14:42:09Z", ok: true},
+		{name: "tank@daily-2026-10-14T14:42:09.5Z", label: "daily", at: "2026-10-14T14:42:09.5Z", ok: true},
+		// named in a zone west of UTC before names were in UTC
+		{name: "tank@daily-2026-10-14T09:42:09-05:00", label: "daily", at: "2026-10-14T14:42:09Z", ok: true},
+		{name: "tank@my-label-2026-10-14T14:42:09Z", label: "my-label", at: "2026-10-14T14:42:09Z", ok: true},
+		{name: "tank@release-1.2.3"},
+	} {
+		label, at, ok := parseSnapshotName(tc.name)
+		if ok != tc.ok {
+			t.Errorf("%s: parsed %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		want, err := time.Parse(time.RFC3339, tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if label != tc.label || !at.Equal(want) {
+			t.Errorf("%s: parsed %q %s, want %q %s", tc.name, label, at, tc.label, want)
+		}
+	}
+}
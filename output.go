@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Output formats supported by the read commands.
+// json and yaml share the same field names, yaml keys are sorted.
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+var outputFlag = cli.StringFlag{
+	Name:  "output",
+	Usage: "output format (text, json, yaml)",
+	Value: outputText,
+}
+
+// textRenderer is implemented by the values commands render
+type textRenderer interface {
+	renderText(w io.Writer) error
+}
+
+func validateOutput(format string) error {
+	switch format {
+	case outputText, outputJSON, outputYAML:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// render writes v to w in the format
+func render(w io.Writer, format string, v textRenderer) error {
+	switch format {
+	case outputText:
+		return v.renderText(w)
+	case outputJSON:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case outputYAML:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		writeYAML(&b, generic, 0)
+		_, err = w.Write(b.Bytes())
+		return err
+	}
+	return validateOutput(format)
+}
+
+// writeYAML writes the decoded json value v as yaml
+func writeYAML(b *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString(pad + k + ":")
+			writeYAMLChild(b, t[k], indent+1)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, e := range t {
+			b.WriteString(pad + "-")
+			writeYAMLChild(b, e, indent+1)
+		}
+	default:
+		b.WriteString(pad + yamlScalar(t) + "\n")
+	}
+}
+
+// writeYAMLChild writes v following a key or list item marker
+func writeYAMLChild(b *bytes.Buffer, v interface{}, indent int) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+	default:
+		b.WriteString(" " + yamlScalar(t) + "\n")
+		return
+	}
+	b.WriteString("\n")
+	writeYAML(b, v, indent)
+}
+
+func yamlScalar(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case string:
+		// json quoted strings are valid yaml double quoted scalars
+		data, _ := json.Marshal(t)
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
+
+// displayLocation is the time zone of the times commands display, set by
+// the global --tz. Snapshot names are always in UTC whatever the zone.
+var displayLocation = time.Local
+
+// displayTime returns t in the display time zone, json encodes it as
+// RFC3339 with the offset of that zone
+func displayTime(t time.Time) time.Time {
+	return t.In(displayLocation)
+}
+
+// formatTime returns the absolute time t in the display time zone
+func formatTime(t time.Time) string {
+	return displayTime(t).Format("2006-01-02 15:04:05 MST")
+}
+
+// formatAge returns the age of t relative to now (3h ago)
+func formatAge(now, t time.Time) string {
+	d := now.Sub(t)
+	suffix := " ago"
+	if d < 0 {
+		d, suffix = -d, " from now"
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm%s", int(d/time.Minute), suffix)
+	case d < Day:
+		return fmt.Sprintf("%dh%s", int(d/time.Hour), suffix)
+	case d < 2*Week:
+		return fmt.Sprintf("%dd%s", int(d/Day), suffix)
+	}
+	return fmt.Sprintf("%dw%s", int(d/Week), suffix)
+}
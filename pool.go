@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// poolCheckTimeout bounds the health check, commands against a suspended
+// pool can block forever
+const poolCheckTimeout = 30 * time.Second
+
+// unhealthyStates are the pool health states flux refuses to snapshot or send on
+var unhealthyStates = map[string]bool{
+	"FAULTED":   true,
+	"SUSPENDED": true,
+	"UNAVAIL":   true,
+	"OFFLINE":   true,
+	"REMOVED":   true,
+}
+
+// poolHealthError is returned when a pool is not healthy enough to use
+type poolHealthError struct {
+	pool   string
+	health string
+}
+
+func (e poolHealthError) Error() string {
+	return fmt.Sprintf("pool %s is %s, refusing to continue without --force", e.pool, e.health)
+}
+
+// checkPool returns a poolHealthError if the pool is in an unhealthy state
+func checkPool(ctx context.Context, pool string) error {
+	ctx, cancel := context.WithTimeout(ctx, poolCheckTimeout)
+	defer cancel()
+	out, err := command(ctx, "zpool", "list", "-H", "-o", "health", pool).Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return poolHealthError{pool: pool, health: "not responding"}
+		}
+		return fmt.Errorf("get health of pool %s: %w", pool, err)
+	}
+	health := strings.TrimSpace(string(out))
+	log := logrus.WithFields(logrus.Fields{
+		"pool":   pool,
+		"health": health,
+	})
+	if unhealthyStates[health] {
+		log.Error("pool is unhealthy")
+		return poolHealthError{pool: pool, health: health}
+	}
+	if health != "ONLINE" {
+		log.Warn("pool is not online")
+		return nil
+	}
+	log.Debug("pool health")
+	return nil
+}
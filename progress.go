@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// progress aggregates the bytes sent by concurrent sends so that a run
+// over many datasets reports a single summary instead of one bar per send.
+// A nil progress counts nothing.
+type progress struct {
+	mu       sync.Mutex
+	counters map[string]*int64
+}
+
+func newProgress() *progress {
+	return &progress{
+		counters: make(map[string]*int64),
+	}
+}
+
+// counter returns the counter of the bytes sent for the dataset
+func (p *progress) counter(name string) *byteCounter {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, ok := p.counters[name]
+	if !ok {
+		n = new(int64)
+		p.counters[name] = n
+	}
+	return &byteCounter{n: n}
+}
+
+// snapshot returns the bytes sent per snapshot and in total
+func (p *progress) snapshot() (map[string]int64, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var (
+		total int64
+		sent  = make(map[string]int64, len(p.counters))
+	)
+	for name, n := range p.counters {
+		v := atomic.LoadInt64(n)
+		sent[name] = v
+		total += v
+	}
+	return sent, total
+}
+
+// report logs the bytes sent every interval until ctx is done
+func (p *progress) report(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.log()
+		}
+	}
+}
+
+func (p *progress) log() {
+	sent, total := p.snapshot()
+	if len(sent) == 0 {
+		return
+	}
+	var names []string
+	for name := range sent {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := logrus.Fields{
+		"total": formatBytes(uint64(total)),
+	}
+	for _, name := range names {
+		fields[name] = formatBytes(uint64(sent[name]))
+	}
+	logrus.WithFields(fields).Info("send progress")
+}
+
+// byteCounter counts the bytes written through it.
+// A nil counter counts nothing.
+type byteCounter struct {
+	n *int64
+}
+
+// bytes returns the bytes counted
+func (c *byteCounter) bytes() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(c.n)
+}
+
+// wrap returns w counting the bytes written to it
+func (c *byteCounter) wrap(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return &countingWriter{w: w, n: c.n}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
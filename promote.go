@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var promoteCommand = cli.Command{
+	Name:      "promote",
+	Usage:     "promote a clone so that its origin snapshot and dataset can be destroyed",
+	ArgsUsage: "<clone>",
+	Action: func(clix *cli.Context) error {
+		name := clix.Args().First()
+		if name == "" {
+			return errors.New("no clone specified")
+		}
+		clone, err := zfs.GetDataset(name)
+		if err != nil {
+			return err
+		}
+		if clone.Origin == "" || clone.Origin == "-" {
+			return fmt.Errorf("%s is not a clone", name)
+		}
+		if dryRun(clix) {
+			fmt.Println(shellJoin([]string{"zfs", "promote", name}))
+			return nil
+		}
+		logrus.WithFields(logrus.Fields{
+			"clone":  name,
+			"origin": clone.Origin,
+		}).Info("promoting")
+		if _, err := zfsOutput(appContext(clix), "promote", name); err != nil {
+			return err
+		}
+		// the origin snapshot and the older snapshots moved to the promoted
+		// clone, the former origin dataset is now a clone of it
+		former, err := zfs.GetDataset(baseName(clone.Origin))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("promoted %s, %s is now a clone of %s\n", name, former.Name, former.Origin)
+		return nil
+	},
+}
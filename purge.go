@@ -0,0 +1,1125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var purgeCommand = cli.Command{
+	Name:      "purge",
+	Usage:     "purge old snapshots of the datasets",
+	ArgsUsage: "[dataset...]",
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "older-than,o",
+			Usage: "purge snapshots older than",
+			Value: 2 * Week,
+		},
+		cli.DurationFlag{
+			Name:  "newer-than",
+			Usage: "purge snapshots newer than, combined with --older-than purges the snapshots between both ages",
+		},
+		cli.BoolFlag{
+			Name:  "relative-to-newest",
+			Usage: "measure ages from the newest snapshot of each dataset instead of now so a stale dataset keeps its last window",
+		},
+		cli.DurationFlag{
+			Name:  "recent",
+			Usage: "keep every snapshot newer than, and only --keep-archive older ones, instead of --older-than",
+		},
+		cli.IntFlag{
+			Name:  "keep-archive",
+			Usage: "number of snapshots older than --recent kept per dataset",
+		},
+		cli.IntFlag{
+			Name:  "min-keep",
+			Usage: "always keep the newest snapshots of each dataset, applied after the age selection including --relative-to-newest",
+		},
+		cli.StringFlag{
+			Name:  "compare-policy",
+			Usage: "show what a proposed policy (\"older-than=72h retention=daily=7\") destroys or keeps compared to the current one without destroying",
+		},
+		cli.StringFlag{
+			Name:  "match",
+			Usage: "only purge snapshots whose name after the @ matches the glob (backup-*)",
+		},
+		cli.StringFlag{
+			Name:  "retention",
+			Usage: "keep the newest snapshots per dataset and label (hourly=24,daily=14), other labels are kept",
+		},
+		keepFirstFlag,
+		keepBookmarksFlag,
+		cli.BoolFlag{
+			Name:  "only-if-sent",
+			Usage: "keep snapshots newer than the flux:last-sent snapshot of their dataset, keeping all of them when nothing was sent",
+		},
+		cli.BoolFlag{
+			Name:  "dry",
+			Usage: "display don't delete",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "include snapshots not created by flux",
+		},
+		cli.BoolFlag{
+			Name:  "i-know-what-im-doing",
+			Usage: "purge every dataset of tank when no dataset is given, as purge did before it required one",
+		},
+		destroyModeFlag,
+		destroyDelayFlag,
+		destroyBatchFlag,
+		cli.IntFlag{
+			Name:  "limit",
+			Usage: "destroy at most this many snapshots per run, oldest first, later runs destroy the rest",
+		},
+		cli.BoolFlag{
+			Name:  "defer",
+			Usage: "mark snapshots with holds for destroy once the last hold is released, held snapshots are skipped otherwise, even with the deferred destroy mode",
+		},
+		cli.BoolFlag{
+			Name:  "break-holds",
+			Usage: "release the holds of other tools (zrepl, syncoid) on snapshots to destroy them, held snapshots are skipped otherwise",
+		},
+		cli.BoolFlag{
+			Name:  "destroy-clones",
+			Usage: "destroy snapshots with dependent clones along with the clones, use with extreme caution",
+		},
+		depthFlag,
+		sortByFlag,
+		labelFlag,
+		scheduleFlag,
+		datasetFileFlag,
+		profileFlag,
+		datasetRegexFlag,
+		outputFlag,
+	},
+	Action: func(clix *cli.Context) error {
+		if err := validateOutput(clix.String("output")); err != nil {
+			return err
+		}
+		entries, err := datasetEntries(clix)
+		if err != nil {
+			return err
+		}
+		mode, err := parseDestroyMode(clix.String("destroy-mode"))
+		if err != nil {
+			return err
+		}
+		list, err := newListOpts(clix)
+		if err != nil {
+			return err
+		}
+		ctx := appContext(clix)
+		re, err := datasetRegex(clix)
+		if err != nil {
+			return err
+		}
+		match := clix.String("match")
+		if err := validateMatch(match); err != nil {
+			return err
+		}
+		keepFirst, err := parseKeepFirst(clix.String("keep-first"))
+		if err != nil {
+			return err
+		}
+		if clix.IsSet("keep-archive") && clix.Duration("recent") <= 0 {
+			return errors.New("--keep-archive requires --recent")
+		}
+		if clix.Duration("recent") > 0 && clix.Duration("newer-than") > 0 {
+			return errors.New("--recent cannot be combined with --newer-than")
+		}
+		if len(entries) == 0 {
+			// purging a whole pool by omission is too easy a mistake
+			if !clix.Bool("i-know-what-im-doing") {
+				return errors.New("no dataset specified, pass the datasets to purge or --i-know-what-im-doing to purge all of tank")
+			}
+			e, err := defaultEntry(clix)
+			if err != nil {
+				return err
+			}
+			e.Name = "tank"
+			if err := e.validate(); err != nil {
+				return err
+			}
+			entries = append(entries, e.expand()...)
+		}
+		var (
+			now     = time.Now()
+			report  = purgeReport{}
+			diff    = policyDiff{}
+			compare = strings.Fields(clix.String("compare-policy"))
+			failed  destroyError
+			limit   = clix.Int("limit")
+			// used and over count the destroys within and over the limit
+			used, over int
+		)
+		if limit < 0 {
+			return errors.New("--limit must not be negative")
+		}
+		for _, e := range entries {
+			policy := e.policy()
+			policy.managedOnly = !clix.Bool("all")
+			policy.destroyClones = clix.Bool("destroy-clones")
+			policy.destroyMode = mode
+			policy.newerThan = clix.Duration("newer-than")
+			policy.match = match
+			policy.relativeToNewest = clix.Bool("relative-to-newest")
+			policy.minKeep = clix.Int("min-keep")
+			policy.recent = clix.Duration("recent")
+			policy.keepArchive = clix.Int("keep-archive")
+			policy.deferHeld = clix.Bool("defer")
+			policy.breakHolds = clix.Bool("break-holds")
+			policy.destroyDelay = clix.Duration("destroy-delay")
+			policy.destroyBatch = clix.Int("destroy-batch")
+			policy.keepFirst = keepFirst
+			if policy.newerThan > 0 && policy.olderThan >= policy.newerThan {
+				return fmt.Errorf("older-than %s must be less than newer-than %s", policy.olderThan, policy.newerThan)
+			}
+
+			if _, err := zfs.GetDataset(e.Name); err != nil {
+				return err
+			}
+			snapshots, err := localhost.snapshots(e.Name, list)
+			if err != nil {
+				return err
+			}
+			if re != nil {
+				snapshots = matchDatasets(snapshots, re)
+			}
+			if policy.quotas, err = snapshotQuotas(ctx, snapshots); err != nil {
+				return err
+			}
+			decisions := policy.checkClones(policy.decide(now, snapshots))
+			if clix.Bool("only-if-sent") {
+				decisions = keepUnsent(ctx, decisions, snapshots)
+			}
+			if len(compare) > 0 {
+				proposed := e
+				for _, field := range compare {
+					if err := proposed.set(field); err != nil {
+						return fmt.Errorf("compare-policy: %w", err)
+					}
+				}
+				p := proposed.policy()
+				p.managedOnly = policy.managedOnly
+				p.destroyClones = policy.destroyClones
+				p.destroyMode = policy.destroyMode
+				p.newerThan = policy.newerThan
+				p.match = policy.match
+				p.relativeToNewest = policy.relativeToNewest
+				p.minKeep = policy.minKeep
+				p.recent = policy.recent
+				p.keepArchive = policy.keepArchive
+				p.quotas = policy.quotas
+				p.keepFirst = policy.keepFirst
+				proposedDecisions := p.checkClones(p.decide(now, snapshots))
+				if clix.Bool("only-if-sent") {
+					proposedDecisions = keepUnsent(ctx, proposedDecisions, snapshots)
+				}
+				diff = append(diff, comparePolicies(decisions, proposedDecisions)...)
+				continue
+			}
+			if clix.IsSet("keep-bookmarks") {
+				bookmarks, err := listBookmarks(ctx, e.Name, list)
+				if err != nil {
+					return err
+				}
+				if re != nil {
+					bookmarks = matchDatasets(bookmarks, re)
+				}
+				decisions = append(decisions, decideBookmarks(bookmarks, clix.Int("keep-bookmarks"), policy.managedOnly)...)
+			}
+			if limit > 0 {
+				var capped int
+				decisions, capped = limitDestroys(decisions, limit-used)
+				used += countDestroys(decisions)
+				over += capped
+			}
+			if dryRun(clix) {
+				report = append(report, newPurgeReport(decisions)...)
+				continue
+			}
+			if err := destroySnapshots(ctx, localhost, policy, decisions, false); err != nil {
+				derr, ok := err.(destroyError)
+				if !ok {
+					return err
+				}
+				failed = append(failed, derr...)
+			}
+		}
+		if len(compare) > 0 {
+			return render(os.Stdout, clix.String("output"), diff)
+		}
+		if over > 0 {
+			logrus.WithFields(logrus.Fields{
+				"limit":     limit,
+				"remaining": over,
+			}).Info("destroy limit reached, remaining snapshots are left for later runs")
+		}
+		if dryRun(clix) {
+			return render(os.Stdout, clix.String("output"), report)
+		}
+		if len(failed) > 0 {
+			return failed
+		}
+		return nil
+	},
+}
+
+// purgePolicy selects the snapshots to destroy
+type purgePolicy struct {
+	olderThan time.Duration
+	// newerThan, when set, only selects snapshots newer than it, together
+	// with olderThan it selects a window of ages
+	newerThan time.Duration
+	// relativeToNewest measures ages from the newest snapshot of each
+	// dataset instead of now
+	relativeToNewest bool
+	// minKeep is the number of newest snapshots per dataset always kept by
+	// the age selection
+	minKeep int
+	// recent, when set, keeps every snapshot newer than it and only the
+	// newest keepArchive older ones instead of selecting by age
+	recent      time.Duration
+	keepArchive int
+	// match restricts the policy to snapshots whose name matches the glob
+	match string
+	// managedOnly restricts the policy to snapshots named by flux
+	managedOnly bool
+	// label restricts the policy to snapshots with the label
+	label string
+	// retention is the number of snapshots to keep per dataset for each label.
+	// When set it replaces the age and label selection.
+	retention map[string]int
+	// keepFirst are the retention tiers keeping the first snapshot of each
+	// period instead of the newest snapshots, the count of the tier is the
+	// number of periods kept
+	keepFirst map[string]time.Duration
+	// destroyClones destroys the dependent clones of a snapshot with it
+	destroyClones bool
+	// destroyMode are the flags snapshots are destroyed with
+	destroyMode zfs.DestroyFlag
+	// deferHeld retries snapshots that failed to destroy because of holds
+	// with a deferred destroy
+	deferHeld bool
+	// quotas are the flux:snapshot-quota of the datasets that have one
+	quotas map[string]uint64
+	// breakHolds releases the holds of other tools on a snapshot to destroy it
+	breakHolds bool
+	// destroyDelay pauses between batches of destroyBatch destroys
+	destroyDelay time.Duration
+	destroyBatch int
+	// destroyed, when set, is called with every snapshot destroyed or
+	// marked for a deferred destroy
+	destroyed func(s *ExtDataset)
+}
+
+// purgeDecision is the outcome of a policy for a single snapshot
+type purgeDecision struct {
+	snapshot *ExtDataset
+	destroy  bool
+	reason   string
+	// clones are the datasets cloned from the snapshot
+	clones []string
+}
+
+// decide returns a decision for every snapshot handled by the policy
+func (p purgePolicy) decide(now time.Time, snapshots []*ExtDataset) []purgeDecision {
+	if p.match != "" {
+		snapshots = matchSnapshots(snapshots, p.match)
+	}
+	if len(p.retention) > 0 {
+		return p.applyQuota(p.decideTiers(snapshots))
+	}
+	var (
+		out        []purgeDecision
+		candidates []*ExtDataset
+		newest     = make(map[string]time.Time)
+	)
+	for _, s := range snapshots {
+		if p.managedOnly && !s.Managed {
+			continue
+		}
+		if s.Label != p.label {
+			continue
+		}
+		candidates = append(candidates, s)
+		if s.Created.After(newest[s.BaseName]) {
+			newest[s.BaseName] = s.Created
+		}
+	}
+	if p.recent > 0 {
+		return p.applyQuota(p.keepMin(p.decideArchive(now, candidates, newest)))
+	}
+	for _, s := range candidates {
+		ref := now
+		if p.relativeToNewest {
+			ref = newest[s.BaseName]
+		}
+		var (
+			mark    = ref.Add(-p.olderThan)
+			newMark = ref.Add(-p.newerThan)
+		)
+		switch {
+		case !s.Created.Before(mark):
+			out = append(out, purgeDecision{
+				snapshot: s,
+				reason:   fmt.Sprintf("newer than %s", p.olderThan),
+			})
+		case p.newerThan > 0 && !s.Created.After(newMark):
+			out = append(out, purgeDecision{
+				snapshot: s,
+				reason:   fmt.Sprintf("older than %s", p.newerThan),
+			})
+		default:
+			out = append(out, purgeDecision{
+				snapshot: s,
+				destroy:  true,
+				reason:   p.ageReason(),
+			})
+		}
+	}
+	return p.applyQuota(p.keepMin(out))
+}
+
+// decideArchive keeps every snapshot newer than recent and at most the
+// newest keepArchive of the older snapshots of each base dataset
+func (p purgePolicy) decideArchive(now time.Time, candidates []*ExtDataset, newest map[string]time.Time) []purgeDecision {
+	var (
+		out      = make([]purgeDecision, len(candidates))
+		archived = make(map[string]int)
+	)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		s := candidates[i]
+		ref := now
+		if p.relativeToNewest {
+			ref = newest[s.BaseName]
+		}
+		switch {
+		case !s.Created.Before(ref.Add(-p.recent)):
+			out[i] = purgeDecision{
+				snapshot: s,
+				reason:   fmt.Sprintf("newer than recent %s", p.recent),
+			}
+		case archived[s.BaseName] < p.keepArchive:
+			archived[s.BaseName]++
+			out[i] = purgeDecision{
+				snapshot: s,
+				reason:   fmt.Sprintf("archive %d of %d", archived[s.BaseName], p.keepArchive),
+			}
+		default:
+			out[i] = purgeDecision{
+				snapshot: s,
+				destroy:  true,
+				reason:   fmt.Sprintf("older than recent %s, archive keeps %d", p.recent, p.keepArchive),
+			}
+		}
+	}
+	return out
+}
+
+// keepMin keeps the newest minKeep snapshots of every base dataset
+func (p purgePolicy) keepMin(decisions []purgeDecision) []purgeDecision {
+	if p.minKeep <= 0 {
+		return decisions
+	}
+	kept := make(map[string]int)
+	for i := len(decisions) - 1; i >= 0; i-- {
+		d := &decisions[i]
+		base := d.snapshot.BaseName
+		if kept[base] >= p.minKeep {
+			continue
+		}
+		kept[base]++
+		if d.destroy {
+			d.destroy = false
+			d.reason = fmt.Sprintf("one of the newest %d kept by min-keep", p.minKeep)
+		}
+	}
+	return decisions
+}
+
+// ageReason describes the ages selected by the policy
+func (p purgePolicy) ageReason() string {
+	switch {
+	case p.newerThan == 0:
+		return fmt.Sprintf("older than %s", p.olderThan)
+	case p.olderThan == 0:
+		return fmt.Sprintf("newer than %s", p.newerThan)
+	}
+	return fmt.Sprintf("between %s and %s old", p.olderThan, p.newerThan)
+}
+
+// decideTiers keeps the newest snapshots of each base dataset and label
+// according to the retention of the label
+func (p purgePolicy) decideTiers(snapshots []*ExtDataset) []purgeDecision {
+	type tierKey struct {
+		base  string
+		label string
+	}
+	var (
+		keys   []tierKey
+		groups = make(map[tierKey][]*ExtDataset)
+	)
+	for _, s := range snapshots {
+		if _, ok := p.retention[s.Label]; !ok || !s.Managed {
+			continue
+		}
+		k := tierKey{base: s.BaseName, label: s.Label}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], s)
+	}
+	var out []purgeDecision
+	for _, k := range keys {
+		var (
+			group = groups[k]
+			keep  = p.retention[k.label]
+			tier  = k.label
+		)
+		if tier == "" {
+			tier = "unlabeled"
+		}
+		if period, ok := p.keepFirst[k.label]; ok {
+			out = append(out, decideFirst(tier, keep, period, group)...)
+			continue
+		}
+		for i, s := range group {
+			if newer := len(group) - i - 1; newer >= keep {
+				out = append(out, purgeDecision{
+					snapshot: s,
+					destroy:  true,
+					reason:   fmt.Sprintf("%s tier keeps %d, %d newer", tier, keep, newer),
+				})
+				continue
+			}
+			out = append(out, purgeDecision{
+				snapshot: s,
+				reason:   fmt.Sprintf("%s tier keeps %d", tier, keep),
+			})
+		}
+	}
+	return out
+}
+
+// decideFirst keeps the first snapshot of each of the newest keep periods of
+// the tier. Periods are aligned to the zero time so days start at midnight UTC.
+func decideFirst(tier string, keep int, period time.Duration, group []*ExtDataset) []purgeDecision {
+	var (
+		periods []time.Time
+		first   = make(map[time.Time]*ExtDataset)
+	)
+	for _, s := range group {
+		start := s.Created.Truncate(period)
+		f, ok := first[start]
+		if !ok {
+			periods = append(periods, start)
+		}
+		if !ok || s.Created.Before(f.Created) {
+			first[start] = s
+		}
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].After(periods[j])
+	})
+	kept := make(map[*ExtDataset]bool)
+	for i, start := range periods {
+		if i >= keep {
+			break
+		}
+		kept[first[start]] = true
+	}
+	var out []purgeDecision
+	for _, s := range group {
+		switch {
+		case kept[s]:
+			out = append(out, purgeDecision{
+				snapshot: s,
+				reason:   fmt.Sprintf("%s tier keeps the first of %d periods of %s", tier, keep, period),
+			})
+		case first[s.Created.Truncate(period)] == s:
+			out = append(out, purgeDecision{
+				snapshot: s,
+				destroy:  true,
+				reason:   fmt.Sprintf("%s tier keeps the newest %d periods of %s", tier, keep, period),
+			})
+		default:
+			out = append(out, purgeDecision{
+				snapshot: s,
+				destroy:  true,
+				reason:   fmt.Sprintf("%s tier keeps the first of its %s period", tier, period),
+			})
+		}
+	}
+	return out
+}
+
+// matchDatasets returns the snapshots whose dataset matches the expression
+func matchDatasets(snapshots []*ExtDataset, re *regexp.Regexp) []*ExtDataset {
+	var out []*ExtDataset
+	for _, s := range snapshots {
+		if re.MatchString(s.BaseName) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// matchSnapshots returns the snapshots whose name after the @ matches the glob
+func matchSnapshots(snapshots []*ExtDataset, pattern string) []*ExtDataset {
+	var out []*ExtDataset
+	for _, s := range snapshots {
+		if ok, _ := path.Match(pattern, shortName(s.Name)); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func validateMatch(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid match pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// purgeReport is the rendered result of a dry purge
+type purgeReport []purgeEntry
+
+type purgeEntry struct {
+	Action   string    `json:"action"`
+	Snapshot string    `json:"snapshot"`
+	Created  time.Time `json:"created"`
+	Reason   string    `json:"reason"`
+}
+
+func newPurgeReport(decisions []purgeDecision) purgeReport {
+	out := purgeReport{}
+	for _, d := range decisions {
+		action := "keep"
+		if d.destroy {
+			action = "destroy"
+		}
+		out = append(out, purgeEntry{
+			Action:   action,
+			Snapshot: d.snapshot.Name,
+			Created:  displayTime(d.snapshot.Created),
+			Reason:   d.reason,
+		})
+	}
+	return out
+}
+
+func (r purgeReport) renderText(w io.Writer) error {
+	now := time.Now()
+	for _, e := range r {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s (%s)\t%s\n", e.Action, e.Snapshot, formatTime(e.Created), formatAge(now, e.Created), e.Reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyDiff are the snapshots a proposed policy handles differently
+type policyDiff []policyChange
+
+type policyChange struct {
+	// Change is destroy for snapshots only the proposed policy destroys
+	// and keep for snapshots only the current policy destroys
+	Change   string `json:"change"`
+	Snapshot string `json:"snapshot"`
+	Current  string `json:"current"`
+	Proposed string `json:"proposed"`
+}
+
+// comparePolicies returns the snapshots the current and proposed decisions
+// disagree on, snapshots without a decision are kept
+func comparePolicies(current, proposed []purgeDecision) policyDiff {
+	var (
+		names []string
+		cur   = make(map[string]purgeDecision)
+		prop  = make(map[string]purgeDecision)
+	)
+	for _, d := range current {
+		names = append(names, d.snapshot.Name)
+		cur[d.snapshot.Name] = d
+	}
+	for _, d := range proposed {
+		if _, ok := cur[d.snapshot.Name]; !ok {
+			names = append(names, d.snapshot.Name)
+		}
+		prop[d.snapshot.Name] = d
+	}
+	out := policyDiff{}
+	for _, name := range names {
+		c, p := cur[name], prop[name]
+		if c.destroy == p.destroy {
+			continue
+		}
+		change := "keep"
+		if p.destroy {
+			change = "destroy"
+		}
+		out = append(out, policyChange{
+			Change:   change,
+			Snapshot: name,
+			Current:  decisionReason(c),
+			Proposed: decisionReason(p),
+		})
+	}
+	return out
+}
+
+func decisionReason(d purgeDecision) string {
+	if d.snapshot == nil {
+		return "not selected"
+	}
+	return d.reason
+}
+
+func (d policyDiff) renderText(w io.Writer) error {
+	for _, c := range d {
+		if _, err := fmt.Fprintf(w, "%s\t%s\tcurrent: %s\tproposed: %s\n", c.Change, c.Snapshot, c.Current, c.Proposed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepUnsent keeps the snapshots selected for destroy that are not older
+// than the last snapshot sent from their dataset. The last sent snapshot is
+// kept as the base of the next incremental send. Datasets without a
+// recorded or existing last sent snapshot keep everything.
+func keepUnsent(ctx context.Context, decisions []purgeDecision, snapshots []*ExtDataset) []purgeDecision {
+	var (
+		byName   = make(map[string]*ExtDataset)
+		lastSent = make(map[string]*ExtDataset)
+		read     = make(map[string]bool)
+	)
+	for _, s := range snapshots {
+		byName[s.Name] = s
+	}
+	for i, d := range decisions {
+		if !d.destroy {
+			continue
+		}
+		base := d.snapshot.BaseName
+		if !read[base] {
+			read[base] = true
+			out, err := zfsOutput(ctx, "get", "-H", "-o", "value", lastSentProp, base)
+			if err != nil {
+				logrus.WithError(err).WithField("dataset", base).Error("get last sent snapshot")
+			} else if name := strings.TrimSpace(string(out)); name != "-" && name != "" {
+				lastSent[base] = byName[base+"@"+name]
+			}
+		}
+		sent := lastSent[base]
+		switch {
+		case sent == nil:
+			decisions[i].destroy = false
+			decisions[i].reason = "no last sent snapshot recorded"
+		case d.snapshot.CreateTXG >= sent.CreateTXG:
+			decisions[i].destroy = false
+			decisions[i].reason = "not older than last sent " + shortName(sent.Name)
+		}
+	}
+	return decisions
+}
+
+// checkClones keeps snapshots selected for destroy that are the origin of
+// a clone unless the policy destroys clones, the clones are read by the
+// same zfs list as the snapshots so no zfs get runs per snapshot
+func (p purgePolicy) checkClones(decisions []purgeDecision) []purgeDecision {
+	for i, d := range decisions {
+		if !d.destroy {
+			continue
+		}
+		clones := d.snapshot.Clones
+		if len(clones) == 0 {
+			continue
+		}
+		decisions[i].clones = clones
+		if p.destroyClones {
+			decisions[i].reason += ", destroying clones " + strings.Join(clones, ",")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"snapshot": d.snapshot.Name,
+			"clones":   strings.Join(clones, ","),
+		}).Info("skipping snapshot with dependent clones")
+		decisions[i].destroy = false
+		decisions[i].reason = "origin of clones " + strings.Join(clones, ",")
+	}
+	return decisions
+}
+
+func getClones(s *ExtDataset) ([]string, error) {
+	v, err := s.GetProperty("clones")
+	if err != nil {
+		return nil, err
+	}
+	return splitClones(v), nil
+}
+
+func splitClones(v string) []string {
+	if v == "" || v == "-" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// parseRetention parses label=count pairs separated by commas
+func parseRetention(s string) (map[string]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	retention := make(map[string]int)
+	for _, tier := range strings.Split(s, ",") {
+		parts := strings.SplitN(tier, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention %q, expected label=count", tier)
+		}
+		if err := validateLabel(parts[0]); err != nil {
+			return nil, err
+		}
+		keep, err := strconv.Atoi(parts[1])
+		if err != nil || keep < 0 {
+			return nil, fmt.Errorf("invalid retention count %q for %s", parts[1], parts[0])
+		}
+		retention[parts[0]] = keep
+	}
+	return retention, nil
+}
+
+var keepFirstFlag = cli.StringFlag{
+	Name:  "keep-first",
+	Usage: "retention tiers keeping the first snapshot of each period instead of the newest snapshots (daily=24h), the tier count is the number of periods kept",
+}
+
+// parseKeepFirst parses label=period pairs separated by commas
+func parseKeepFirst(s string) (map[string]time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+	keepFirst := make(map[string]time.Duration)
+	for _, tier := range strings.Split(s, ",") {
+		parts := strings.SplitN(tier, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid keep-first %q, expected label=period", tier)
+		}
+		if err := validateLabel(parts[0]); err != nil {
+			return nil, err
+		}
+		period, err := time.ParseDuration(parts[1])
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid keep-first period %q for %s", parts[1], parts[0])
+		}
+		keepFirst[parts[0]] = period
+	}
+	return keepFirst, nil
+}
+
+// destroyModes map the --destroy-mode names to the zfs destroy flags.
+//
+//	default           fails on snapshots with holds or clones
+//	deferred          (-d) marks held snapshots for destroy when the last hold is released
+//	recursive         (-r) also destroys the same named snapshot of all descendant datasets
+//	recursive-clones  (-R) also destroys all dependents, including clones outside the tree
+var destroyModes = map[string]zfs.DestroyFlag{
+	"default":          zfs.DestroyDefault,
+	"deferred":         zfs.DestroyDeferDeletion,
+	"recursive":        zfs.DestroyRecursive,
+	"recursive-clones": zfs.DestroyRecursiveClones,
+}
+
+var destroyModeFlag = cli.StringFlag{
+	Name:  "destroy-mode",
+	Usage: "destroy mode (default, deferred, recursive, recursive-clones), recursive modes also destroy descendants and dependents",
+	Value: "deferred",
+}
+
+var destroyDelayFlag = cli.DurationFlag{
+	Name:  "destroy-delay",
+	Usage: "pause between destroys so purging thousands of snapshots on a busy pool does not flood it with transaction groups",
+}
+
+var destroyBatchFlag = cli.IntFlag{
+	Name:  "destroy-batch",
+	Usage: "number of destroys between the pauses of --destroy-delay",
+	Value: 1,
+}
+
+// snapshotHolds returns the tags of the holds on the snapshot, from flux
+// or any other tool, bookmarks cannot be held
+func snapshotHolds(h host, s *ExtDataset) ([]string, error) {
+	if s.Type == TypeBookmark {
+		return nil, nil
+	}
+	return h.holds(s)
+}
+
+// releaseHolds releases every hold on the snapshot
+func releaseHolds(h host, s *ExtDataset, tags []string) error {
+	for _, tag := range tags {
+		if err := h.release(s, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttle pauses for the destroy delay before every batch of destroys
+// except the first, n is the number of destroys attempted so far
+func (p purgePolicy) throttle(ctx context.Context, n int) error {
+	if p.destroyDelay <= 0 || n == 0 {
+		return nil
+	}
+	batch := p.destroyBatch
+	if batch < 1 {
+		batch = 1
+	}
+	if n%batch != 0 {
+		return nil
+	}
+	return waitUntil(ctx, time.Now().Add(p.destroyDelay))
+}
+
+// limitDestroys keeps every destroy after the oldest limit, returning the
+// number kept because of the limit
+func limitDestroys(decisions []purgeDecision, limit int) ([]purgeDecision, int) {
+	var destroys []int
+	for i, d := range decisions {
+		if d.destroy {
+			destroys = append(destroys, i)
+		}
+	}
+	if len(destroys) <= limit {
+		return decisions, 0
+	}
+	sort.SliceStable(destroys, func(i, j int) bool {
+		return decisions[destroys[i]].snapshot.Created.Before(decisions[destroys[j]].snapshot.Created)
+	})
+	for _, i := range destroys[limit:] {
+		decisions[i].destroy = false
+		decisions[i].reason = "over the destroy limit, left for a later run"
+	}
+	return decisions, len(destroys) - limit
+}
+
+func countDestroys(decisions []purgeDecision) int {
+	var n int
+	for _, d := range decisions {
+		if d.destroy {
+			n++
+		}
+	}
+	return n
+}
+
+func parseDestroyMode(mode string) (zfs.DestroyFlag, error) {
+	flags, ok := destroyModes[mode]
+	if !ok {
+		return 0, fmt.Errorf("unknown destroy mode %q", mode)
+	}
+	return flags, nil
+}
+
+// destroyFailure is a snapshot that could not be destroyed
+type destroyFailure struct {
+	snapshot string
+	// reason is why zfs refused the destroy, if known
+	reason string
+	err    error
+}
+
+func (f destroyFailure) String() string {
+	if f.reason != "" {
+		return fmt.Sprintf("%s: %s", f.snapshot, f.reason)
+	}
+	return fmt.Sprintf("%s: %v", f.snapshot, f.err)
+}
+
+// destroyReason explains a failed destroy of the snapshot, listing the
+// holds or clones that have to be released first
+func destroyReason(h host, s *ExtDataset, err error) string {
+	msg := errorOutput(err)
+	switch {
+	case strings.Contains(msg, "dependent clones"):
+		if clones, cerr := h.clones(s); cerr == nil && len(clones) > 0 {
+			return "has dependent clones " + strings.Join(clones, ",")
+		}
+		return "has dependent clones"
+	case strings.Contains(msg, "busy"):
+		if tags, herr := h.holds(s); herr == nil && len(tags) > 0 {
+			return "has holds " + strings.Join(tags, ",")
+		}
+		return "busy"
+	}
+	return ""
+}
+
+// errorOutput returns the zfs stderr of err
+func errorOutput(err error) string {
+	var zerr *zfs.Error
+	if errors.As(err, &zerr) {
+		return zerr.Stderr
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return string(exit.Stderr)
+	}
+	return err.Error()
+}
+
+// destroyError is returned when some of the snapshots could not be destroyed
+type destroyError []destroyFailure
+
+func (e destroyError) Error() string {
+	var failures []string
+	for _, f := range e {
+		failures = append(failures, f.String())
+	}
+	return fmt.Sprintf("unable to destroy %d snapshots: %s", len(e), strings.Join(failures, "; "))
+}
+
+// destroySnapshots destroys the snapshots selected by the decisions and returns
+// a destroyError for every snapshot that failed to destroy
+func destroySnapshots(ctx context.Context, h host, policy purgePolicy, decisions []purgeDecision, dry bool) error {
+	var (
+		failed    destroyError
+		destroyed int
+		deferred  int
+		held      int
+		attempts  int
+	)
+	for _, d := range decisions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.destroy {
+			continue
+		}
+		s := d.snapshot
+		logrus.Debugf("destory %s", s.Name)
+		if dry {
+			continue
+		}
+		if err := policy.throttle(ctx, attempts); err != nil {
+			return err
+		}
+		attempts++
+		var (
+			flags     = policy.destroyMode
+			deferring bool
+		)
+		tags, err := snapshotHolds(h, s)
+		if err != nil {
+			logrus.WithError(err).WithField("snapshot", s.Name).Error("get holds")
+			failed = append(failed, destroyFailure{
+				snapshot: s.Name,
+				reason:   "unable to check holds",
+				err:      err,
+			})
+			continue
+		}
+		if len(tags) > 0 {
+			log := logrus.WithFields(logrus.Fields{
+				"snapshot": s.Name,
+				"holds":    strings.Join(tags, ","),
+			})
+			switch {
+			case policy.breakHolds:
+				if err := releaseHolds(h, s, tags); err != nil {
+					log.WithError(err).Error("unable to release holds")
+					failed = append(failed, destroyFailure{
+						snapshot: s.Name,
+						reason:   "has holds " + strings.Join(tags, ","),
+						err:      err,
+					})
+					continue
+				}
+				log.Warn("released holds")
+			case policy.deferHeld:
+				// the deferred destroy mode alone does not opt in, the
+				// holds of other tools are kept unless asked otherwise
+				flags |= zfs.DestroyDeferDeletion
+				deferring = true
+			default:
+				log.Info("skipping snapshot held by another tool, use --break-holds or --defer to override")
+				held++
+				continue
+			}
+		}
+		if len(d.clones) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"snapshot": s.Name,
+				"clones":   strings.Join(d.clones, ","),
+			}).Warn("destroying snapshot with dependent clones")
+			flags |= zfs.DestroyRecursiveClones
+		}
+		if err := h.destroy(s, flags); err != nil {
+			f := destroyFailure{
+				snapshot: s.Name,
+				reason:   destroyReason(h, s, err),
+				err:      err,
+			}
+			if policy.deferHeld && flags&zfs.DestroyDeferDeletion == 0 && strings.HasPrefix(f.reason, "has holds") {
+				if err := h.destroy(s, flags|zfs.DestroyDeferDeletion); err == nil {
+					if policy.destroyed != nil {
+						policy.destroyed(s)
+					}
+					deferred++
+					logrus.WithFields(logrus.Fields{
+						"snapshot": s.Name,
+						"reason":   f.reason,
+					}).Info("deferred destroy until the holds are released")
+					continue
+				}
+			}
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"snapshot": s.Name,
+				"reason":   f.reason,
+			}).Error("unable destroy")
+			failed = append(failed, f)
+			continue
+		}
+		if policy.destroyed != nil {
+			policy.destroyed(s)
+		}
+		if deferring {
+			deferred++
+			logrus.WithFields(logrus.Fields{
+				"snapshot": s.Name,
+				"holds":    strings.Join(tags, ","),
+			}).Info("deferred destroy until the holds are released")
+			continue
+		}
+		destroyed++
+		logrus.WithField("snapshot", s.Name).Info("destroyed")
+	}
+	logrus.WithFields(logrus.Fields{
+		"destroyed": destroyed,
+		"deferred":  deferred,
+		"held":      held,
+		"failed":    len(failed),
+	}).Info("purge complete")
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
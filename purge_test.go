@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+)
+
+func TestDestroyHeldSnapshots(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		policy    purgePolicy
+		destroyed []string
+		flags     zfs.DestroyFlag
+		released  []string
+	}{
+		{
+			name:      "deferred mode skips held",
+			policy:    purgePolicy{destroyMode: destroyModes["deferred"]},
+			destroyed: []string{"tank/home@a"},
+			flags:     zfs.DestroyDeferDeletion,
+		},
+		{
+			name:      "default mode skips held",
+			policy:    purgePolicy{destroyMode: destroyModes["default"]},
+			destroyed: []string{"tank/home@a"},
+			flags:     zfs.DestroyDefault,
+		},
+		{
+			name:      "defer",
+			policy:    purgePolicy{destroyMode: destroyModes["default"], deferHeld: true},
+			destroyed: []string{"tank/home@a", "tank/home@b"},
+			flags:     zfs.DestroyDefault | zfs.DestroyDeferDeletion,
+		},
+		{
+			name:      "break holds",
+			policy:    purgePolicy{destroyMode: destroyModes["deferred"], breakHolds: true},
+			destroyed: []string{"tank/home@a", "tank/home@b"},
+			flags:     zfs.DestroyDeferDeletion,
+			released:  []string{"tank/home@b zrepl"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &fakeHost{held: map[string][]string{"tank/home@b": {"zrepl"}}}
+			decisions := []purgeDecision{
+				{snapshot: snap("tank/home@a", 1), destroy: true},
+				{snapshot: snap("tank/home@b", 2), destroy: true},
+				{snapshot: snap("tank/home@c", 3)},
+			}
+			if err := destroySnapshots(context.Background(), h, tc.policy, decisions, false); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h.destroyed, tc.destroyed) {
+				t.Errorf("destroyed %v, want %v", h.destroyed, tc.destroyed)
+			}
+			if last := h.flags[len(h.flags)-1]; last != tc.flags {
+				t.Errorf("destroyed with flags %v, want %v", last, tc.flags)
+			}
+			if !reflect.DeepEqual(h.released, tc.released) {
+				t.Errorf("released %v, want %v", h.released, tc.released)
+			}
+		})
+	}
+}
+
+func labeled(label string, created time.Time) *ExtDataset {
+	name := "tank/home@" + snapshotName(label, created)
+	return &ExtDataset{
+		Dataset:  &zfs.Dataset{Name: name},
+		BaseName: "tank/home",
+		Created:  created,
+		Label:    label,
+		Managed:  true,
+	}
+}
+
+// destroyed returns the names of the snapshots the decisions destroy
+func destroyed(decisions []purgeDecision) []string {
+	var names []string
+	for _, d := range decisions {
+		if d.destroy {
+			names = append(names, shortName(d.snapshot.Name))
+		}
+	}
+	return names
+}
+
+func TestDecideFirst(t *testing.T) {
+	day := func(d, h, m, s int) time.Time {
+		return time.Date(2026, 10, d, h, m, s, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		name      string
+		keep      int
+		period    time.Duration
+		created   []time.Time
+		destroyed []string
+	}{
+		{
+			name:   "bucket boundaries",
+			keep:   2,
+			period: Day,
+			created: []time.Time{
+				day(1, 23, 59, 59),
+				day(2, 0, 0, 0),
+				day(2, 12, 0, 0),
+				day(3, 0, 0, 1),
+			},
+			destroyed: []string{
+				"daily-2026-10-01T23:59:59Z",
+				"daily-2026-10-02T12:00:00Z",
+			},
+		},
+		{
+			name:   "fewer periods than the count",
+			keep:   5,
+			period: Day,
+			created: []time.Time{
+				day(1, 6, 0, 0),
+				day(1, 18, 0, 0),
+				day(2, 6, 0, 0),
+			},
+			destroyed: []string{"daily-2026-10-01T18:00:00Z"},
+		},
+		{
+			name:   "hourly periods",
+			keep:   1,
+			period: time.Hour,
+			created: []time.Time{
+				day(1, 6, 59, 59),
+				day(1, 7, 0, 0),
+				day(1, 7, 30, 0),
+			},
+			destroyed: []string{
+				"daily-2026-10-01T06:59:59Z",
+				"daily-2026-10-01T07:30:00Z",
+			},
+		},
+	} {
+		var group []*ExtDataset
+		for _, c := range tc.created {
+			group = append(group, labeled("daily", c))
+		}
+		got := destroyed(decideFirst("daily", tc.keep, tc.period, group))
+		if !reflect.DeepEqual(got, tc.destroyed) {
+			t.Errorf("%s: destroyed %v, want %v", tc.name, got, tc.destroyed)
+		}
+	}
+}
+
+func TestDecideTiersMixed(t *testing.T) {
+	keepFirst, err := parseKeepFirst("daily=24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := purgePolicy{
+		retention: map[string]int{"daily": 2, "hourly": 2},
+		keepFirst: keepFirst,
+	}
+	var snapshots []*ExtDataset
+	for _, h := range []int{0, 12, 24, 36, 48} {
+		at := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(h) * time.Hour)
+		snapshots = append(snapshots, labeled("daily", at), labeled("hourly", at))
+	}
+	want := []string{
+		// the first of the two newest days of the period tier
+		"daily-2026-10-01T00:00:00Z",
+		"daily-2026-10-01T12:00:00Z",
+		"daily-2026-10-02T12:00:00Z",
+		// the two newest of the plain tier
+		"hourly-2026-10-01T00:00:00Z",
+		"hourly-2026-10-01T12:00:00Z",
+		"hourly-2026-10-02T00:00:00Z",
+	}
+	got := destroyed(p.decideTiers(snapshots))
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("destroyed %v, want %v", got, want)
+	}
+}
+
+func TestParseKeepFirst(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want map[string]time.Duration
+		ok   bool
+	}{
+		{in: "", ok: true},
+		{in: "daily=24h", want: map[string]time.Duration{"daily": Day}, ok: true},
+		{in: "daily=24h,weekly=168h", want: map[string]time.Duration{"daily": Day, "weekly": Week}, ok: true},
+		{in: "=1h", want: map[string]time.Duration{"": time.Hour}, ok: true},
+		{in: "daily"},
+		{in: "daily=soon"},
+		{in: "daily=0s"},
+		{in: "daily=-1h"},
+		{in: "my label=1h"},
+	} {
+		got, err := parseKeepFirst(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: error %v", tc.in, err)
+			continue
+		}
+		if tc.ok && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: parsed %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestCheckClones(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		policy    purgePolicy
+		destroyed []string
+		flags     []zfs.DestroyFlag
+	}{
+		{
+			name:      "skip origins",
+			policy:    purgePolicy{destroyMode: destroyModes["deferred"]},
+			destroyed: []string{"tank/home@b"},
+			flags:     []zfs.DestroyFlag{zfs.DestroyDeferDeletion},
+		},
+		{
+			name:      "destroy clones",
+			policy:    purgePolicy{destroyMode: destroyModes["deferred"], destroyClones: true},
+			destroyed: []string{"tank/home@a", "tank/home@b"},
+			flags: []zfs.DestroyFlag{
+				zfs.DestroyDeferDeletion | zfs.DestroyRecursiveClones,
+				zfs.DestroyDeferDeletion,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := snap("tank/home@a", 1)
+			origin.Clones = []string{"tank/scratch"}
+			decisions := tc.policy.checkClones([]purgeDecision{
+				{snapshot: origin, destroy: true, reason: "older than 24h0m0s"},
+				{snapshot: snap("tank/home@b", 2), destroy: true, reason: "older than 24h0m0s"},
+				{snapshot: snap("tank/home@c", 3)},
+			})
+			if got := decisions[0].destroy; got != tc.policy.destroyClones {
+				t.Errorf("origin destroy %v, want %v (%s)", got, tc.policy.destroyClones, decisions[0].reason)
+			}
+			if !tc.policy.destroyClones && decisions[0].reason != "origin of clones tank/scratch" {
+				t.Errorf("origin kept because %q", decisions[0].reason)
+			}
+			h := &fakeHost{}
+			if err := destroySnapshots(context.Background(), h, tc.policy, decisions, false); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h.destroyed, tc.destroyed) {
+				t.Errorf("destroyed %v, want %v", h.destroyed, tc.destroyed)
+			}
+			if !reflect.DeepEqual(h.flags, tc.flags) {
+				t.Errorf("destroyed with flags %v, want %v", h.flags, tc.flags)
+			}
+		})
+	}
+}
+
+func TestDecideLabelAge(t *testing.T) {
+	var (
+		now    = time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+		old    = now.Add(-48 * time.Hour)
+		recent = now.Add(-time.Hour)
+	)
+	snapshots := []*ExtDataset{
+		labeled("daily", old),
+		labeled("hourly", old),
+		labeled("weekly", old),
+		labeled("daily", recent),
+		labeled("hourly", recent),
+	}
+	for _, tc := range []struct {
+		label     string
+		destroyed []string
+	}{
+		{label: "hourly", destroyed: []string{"hourly-2026-10-12T12:00:00Z"}},
+		{label: "daily", destroyed: []string{"daily-2026-10-12T12:00:00Z"}},
+		{label: "monthly"},
+	} {
+		p := purgePolicy{olderThan: 24 * time.Hour, managedOnly: true, label: tc.label}
+		decisions := p.decide(now, snapshots)
+		if got := destroyed(decisions); !reflect.DeepEqual(got, tc.destroyed) {
+			t.Errorf("%s: destroyed %v, want %v", tc.label, got, tc.destroyed)
+		}
+		for _, d := range decisions {
+			if d.snapshot.Label != tc.label {
+				t.Errorf("%s: decided on %s with another label", tc.label, d.snapshot.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var purgeDestCommand = cli.Command{
+	Name:      "purge-dest",
+	Usage:     "purge old snapshots on the remote destination of a dataset",
+	ArgsUsage: "[dataset...]",
+	Flags: append(remoteFlags,
+		sshMultiplexFlag,
+		cli.DurationFlag{
+			Name:  "older-than,o",
+			Usage: "purge snapshots older than",
+			Value: 2 * Week,
+		},
+		cli.StringFlag{
+			Name:  "retention",
+			Usage: "keep the newest snapshots per dataset and label (hourly=24,daily=14), other labels are kept",
+		},
+		keepFirstFlag,
+		cli.BoolFlag{
+			Name:  "dry",
+			Usage: "display don't delete",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "include snapshots not created by flux",
+		},
+		destroyModeFlag,
+		destroyDelayFlag,
+		destroyBatchFlag,
+		depthFlag,
+		sortByFlag,
+		labelFlag,
+		datasetFileFlag,
+		profileFlag,
+		outputFlag,
+	),
+	Action: func(clix *cli.Context) error {
+		if err := validateOutput(clix.String("output")); err != nil {
+			return err
+		}
+		entries, err := datasetEntries(clix)
+		if err != nil {
+			return err
+		}
+		mode, err := parseDestroyMode(clix.String("destroy-mode"))
+		if err != nil {
+			return err
+		}
+		keepFirst, err := parseKeepFirst(clix.String("keep-first"))
+		if err != nil {
+			return err
+		}
+		list, err := newListOpts(clix)
+		if err != nil {
+			return err
+		}
+		if err := validateTargetUser(clix.String("target-user")); err != nil {
+			return err
+		}
+		if err := validateHostKey(clix.String("target-host-key")); err != nil {
+			return err
+		}
+		mux, err := newSSHMux(clix)
+		if err != nil {
+			return err
+		}
+		defer mux.close()
+		var (
+			ctx    = appContext(clix)
+			now    = time.Now()
+			report = purgeReport{}
+			failed destroyError
+		)
+		for _, e := range entries {
+			if e.Target == "" {
+				return errors.New("no ssh target specified")
+			}
+			policy := e.policy()
+			policy.managedOnly = !clix.Bool("all")
+			policy.destroyMode = mode
+			policy.keepFirst = keepFirst
+			policy.destroyDelay = clix.Duration("destroy-delay")
+			policy.destroyBatch = clix.Int("destroy-batch")
+
+			h := remoteHost{
+				ctx:    ctx,
+				remote: mux.add(newRemote(clix, e.Target)),
+			}
+			remoteSnapshots, err := h.snapshots(e.Dest, list)
+			if err != nil {
+				return err
+			}
+			localSnapshots, err := localhost.snapshots(e.Name, list)
+			if err != nil {
+				return err
+			}
+			decisions := policy.decide(now, remoteSnapshots)
+			for _, s := range lastCommon(e.Name, localSnapshots, e.Dest, remoteSnapshots) {
+				keepSnapshot(decisions, s, "last common snapshot with the source")
+			}
+			decisions = policy.checkClones(decisions)
+			if dryRun(clix) {
+				report = append(report, newPurgeReport(decisions)...)
+				continue
+			}
+			if err := destroySnapshots(ctx, h, policy, decisions, false); err != nil {
+				derr, ok := err.(destroyError)
+				if !ok {
+					return err
+				}
+				failed = append(failed, derr...)
+			}
+		}
+		if dryRun(clix) {
+			return render(os.Stdout, clix.String("output"), report)
+		}
+		if len(failed) > 0 {
+			return failed
+		}
+		return nil
+	},
+}
+
+// lastCommon returns the newest snapshot of each destination dataset that
+// also exists on the source, these are needed for the next incremental send.
+// Snapshots are matched by guid, or by relative name when they have none.
+func lastCommon(source string, local []*ExtDataset, dest string, remote []*ExtDataset) []*ExtDataset {
+	common := make(map[string]bool)
+	for _, s := range local {
+		common[commonID(source, s)] = true
+	}
+	newest := make(map[string]*ExtDataset)
+	var bases []string
+	for _, s := range remote {
+		if !common[commonID(dest, s)] {
+			continue
+		}
+		if _, ok := newest[s.BaseName]; !ok {
+			bases = append(bases, s.BaseName)
+		}
+		if n := newest[s.BaseName]; n == nil || !s.Created.Before(n.Created) {
+			newest[s.BaseName] = s
+		}
+	}
+	var out []*ExtDataset
+	for _, b := range bases {
+		out = append(out, newest[b])
+	}
+	return out
+}
+
+func commonID(root string, s *ExtDataset) string {
+	if s.GUID == 0 {
+		return relativeName(root, s.Name)
+	}
+	return snapshotID(s)
+}
+
+// relativeName returns the snapshot name relative to the root dataset
+func relativeName(root, name string) string {
+	return strings.TrimPrefix(name, root)
+}
+
+// keepSnapshot overrides the decision for the snapshot to keep it
+func keepSnapshot(decisions []purgeDecision, s *ExtDataset, reason string) {
+	for i, d := range decisions {
+		if d.snapshot == s && d.destroy {
+			decisions[i].destroy = false
+			decisions[i].reason = reason
+		}
+	}
+}
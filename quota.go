@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// quotaProp caps the space used by the snapshots of a dataset, when they
+// use more the oldest are purged
+const quotaProp = "flux:snapshot-quota"
+
+// sizeUnits are the binary suffixes of sizes, as used by zfs
+var sizeUnits = map[string]uint64{
+	"":  1,
+	"B": 1,
+	"K": KiB,
+	"M": MiB,
+	"G": GiB,
+	"T": TiB,
+	"P": TiB * KiB,
+}
+
+// parseSize parses a size such as 512M or 1.5T
+func parseSize(s string) (uint64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "IB"), "B")
+	i := strings.IndexFunc(v, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	unit := ""
+	if i >= 0 {
+		v, unit = v[:i], v[i:]
+	}
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint64(n * float64(mult)), nil
+}
+
+// snapshotQuotas returns the snapshot quota of every dataset of the
+// snapshots that has one
+func snapshotQuotas(ctx context.Context, snapshots []*ExtDataset) (map[string]uint64, error) {
+	var (
+		bases []string
+		seen  = make(map[string]bool)
+	)
+	for _, s := range snapshots {
+		if !seen[s.BaseName] {
+			seen[s.BaseName] = true
+			bases = append(bases, s.BaseName)
+		}
+	}
+	if len(bases) == 0 {
+		return nil, nil
+	}
+	out, err := zfsOutput(ctx, append([]string{"get", "-H", "-o", "name,value", quotaProp}, bases...)...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		quotas = make(map[string]uint64)
+		s      = bufio.NewScanner(bytes.NewReader(out))
+	)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 2 || fields[1] == "-" {
+			continue
+		}
+		quota, err := parseSize(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", fields[0], quotaProp, err)
+		}
+		quotas[fields[0]] = quota
+	}
+	return quotas, s.Err()
+}
+
+// applyQuota destroys the oldest kept snapshots of each dataset over its
+// snapshot quota until the kept snapshots fit, the newest minKeep are
+// never destroyed. The used space of a snapshot only counts the blocks
+// unique to it, so destroying snapshots can free more than their sum.
+func (p purgePolicy) applyQuota(decisions []purgeDecision) []purgeDecision {
+	if len(p.quotas) == 0 {
+		return decisions
+	}
+	var (
+		total     = make(map[string]uint64)
+		kept      = make(map[string]int)
+		protected = make(map[int]bool)
+	)
+	for i := len(decisions) - 1; i >= 0; i-- {
+		d := decisions[i]
+		if d.destroy {
+			continue
+		}
+		base := d.snapshot.BaseName
+		total[base] += d.snapshot.Used
+		if kept[base] < p.minKeep {
+			protected[i] = true
+		}
+		kept[base]++
+	}
+	forced := make(map[string]int)
+	for i := range decisions {
+		d := &decisions[i]
+		base := d.snapshot.BaseName
+		quota, ok := p.quotas[base]
+		if !ok || d.destroy || protected[i] || total[base] <= quota {
+			continue
+		}
+		total[base] -= d.snapshot.Used
+		d.destroy = true
+		d.reason = fmt.Sprintf("snapshot quota %s exceeded", formatBytes(quota))
+		forced[base]++
+	}
+	for base, n := range forced {
+		logrus.WithFields(logrus.Fields{
+			"dataset":   base,
+			"quota":     formatBytes(p.quotas[base]),
+			"snapshots": n,
+		}).Info("snapshot quota forced destroys")
+	}
+	return decisions
+}
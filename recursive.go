@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+)
+
+// excludeProp excludes a dataset and, as user properties are inherited,
+// its descendants from recursive snapshots
+const excludeProp = "flux:exclude-recursive"
+
+// expandRecursive replaces every entry with an entry for the dataset and
+// each of its descendants that is not excluded, destinations are mapped
+// to the same relative path under the entry destination.
+//
+// zfs snapshot -r has no way to skip children, so the snapshots are taken
+// per dataset. They are only taken at the same instant with --atomic,
+// otherwise each dataset is snapshotted after the previous one.
+func expandRecursive(ctx context.Context, entries []datasetEntry) ([]datasetEntry, error) {
+	var out []datasetEntry
+	for _, e := range entries {
+		names, err := recursiveDatasets(ctx, e.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			c := e
+			c.Name = name
+			if c.Dest != "" {
+				c.Dest = e.Dest + strings.TrimPrefix(name, e.Name)
+			}
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// includeParents adds an entry for every ancestor of the entries up to the
+// pool before the entries, ancestors are only snapshotted and not sent.
+// Ancestors already listed keep their own entry.
+func includeParents(entries []datasetEntry) []datasetEntry {
+	listed := make(map[string]bool)
+	for _, e := range entries {
+		listed[e.key()] = true
+	}
+	var out []datasetEntry
+	for _, e := range entries {
+		for _, name := range ancestors(e.Name) {
+			c := e
+			c.Name = name
+			c.Target = ""
+			c.Dest = ""
+			c.Parent = true
+			if listed[c.key()] {
+				continue
+			}
+			listed[c.key()] = true
+			out = append(out, c)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// ancestors returns the ancestors of the dataset from the pool down,
+// tank/a/b has the ancestors tank and tank/a
+func ancestors(name string) []string {
+	var out []string
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' {
+			out = append(out, name[:i])
+		}
+	}
+	return out
+}
+
+// recursiveDatasets returns the dataset and its descendants without the
+// datasets excluded by excludeProp
+func recursiveDatasets(ctx context.Context, name string) ([]string, error) {
+	out, err := zfsOutput(ctx, "list", "-H", "-r", "-t", "filesystem,volume", "-o", "name,"+excludeProp, name)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		names []string
+		s     = bufio.NewScanner(bytes.NewReader(out))
+	)
+	for s.Scan() {
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[1] == "true" {
+			continue
+		}
+		names = append(names, fields[0])
+	}
+	return names, s.Err()
+}
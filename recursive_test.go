@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAncestors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want []string
+	}{
+		{name: "tank"},
+		{name: "tank/home", want: []string{"tank"}},
+		{name: "tank/home/db/logs", want: []string{"tank", "tank/home", "tank/home/db"}},
+	} {
+		if got := ancestors(tc.name); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ancestors %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIncludeParents(t *testing.T) {
+	type entry struct {
+		name   string
+		label  string
+		parent bool
+		target string
+	}
+	for _, tc := range []struct {
+		name    string
+		entries []datasetEntry
+		want    []entry
+	}{
+		{
+			name:    "pool root",
+			entries: []datasetEntry{{Name: "tank", Target: "backup", Dest: "backup/tank"}},
+			want:    []entry{{name: "tank", target: "backup"}},
+		},
+		{
+			name:    "up to the pool",
+			entries: []datasetEntry{{Name: "tank/home/db", Target: "backup", Dest: "backup/db"}},
+			want: []entry{
+				{name: "tank", parent: true},
+				{name: "tank/home", parent: true},
+				{name: "tank/home/db", target: "backup"},
+			},
+		},
+		{
+			name: "overlapping datasets",
+			entries: []datasetEntry{
+				{Name: "tank/home/db"},
+				{Name: "tank/home/www"},
+				{Name: "tank/home"},
+				{Name: "data/vm"},
+			},
+			want: []entry{
+				{name: "tank", parent: true},
+				{name: "tank/home/db"},
+				{name: "tank/home/www"},
+				{name: "tank/home"},
+				{name: "data", parent: true},
+				{name: "data/vm"},
+			},
+		},
+		{
+			name: "labels have their own parents",
+			entries: []datasetEntry{
+				{Name: "tank/home", Label: "daily"},
+				{Name: "tank/home", Label: "hourly"},
+				{Name: "tank/www", Label: "daily"},
+			},
+			want: []entry{
+				{name: "tank", label: "daily", parent: true},
+				{name: "tank/home", label: "daily"},
+				{name: "tank", label: "hourly", parent: true},
+				{name: "tank/home", label: "hourly"},
+				{name: "tank/www", label: "daily"},
+			},
+		},
+	} {
+		var got []entry
+		for _, e := range includeParents(tc.entries) {
+			if e.Parent && (e.Target != "" || e.Dest != "") {
+				t.Errorf("%s: parent %s is sent to %s:%s", tc.name, e.Name, e.Target, e.Dest)
+			}
+			got = append(got, entry{name: e.Name, label: e.Label, parent: e.Parent, target: e.Target})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: entries %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var rollbackCommand = cli.Command{
+	Name:      "rollback",
+	Usage:     "rollback a dataset to a snapshot",
+	ArgsUsage: "<dataset>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to-time,t",
+			Usage: "RFC3339 time to rollback to, the newest snapshot at or before it is used",
+		},
+		cli.BoolFlag{
+			Name:  "force,f",
+			Usage: "destroy the snapshots newer than the rollback snapshot",
+		},
+	},
+	Action: func(clix *cli.Context) error {
+		name := clix.Args().First()
+		if name == "" {
+			return errors.New("no dataset specified")
+		}
+		if clix.String("to-time") == "" {
+			return errors.New("no rollback time specified")
+		}
+		at, err := time.Parse(time.RFC3339, clix.String("to-time"))
+		if err != nil {
+			return fmt.Errorf("invalid --to-time: %w", err)
+		}
+		snapshots, err := localhost.snapshots(name, listOpts{depth: 1, sortBy: "creation"})
+		if err != nil {
+			return err
+		}
+		target, newer := rollbackTarget(snapshots, at)
+		if target == nil {
+			return fmt.Errorf("no snapshot of %s at or before %s", name, at.Format(time.RFC3339))
+		}
+		if len(newer) > 0 {
+			var names []string
+			for _, s := range newer {
+				names = append(names, s.Name)
+			}
+			if !clix.Bool("force") {
+				return fmt.Errorf("rollback to %s destroys newer snapshots, use --force to destroy %s", target.Name, strings.Join(names, ", "))
+			}
+			logrus.WithField("snapshots", strings.Join(names, ",")).Warn("destroying snapshots newer than the rollback snapshot")
+		}
+		if dryRun(clix) {
+			fmt.Println(shellJoin(rollbackArgs(target, len(newer) > 0)))
+			return nil
+		}
+		logrus.WithField("snapshot", target.Name).Info("rolling back")
+		return target.Rollback(len(newer) > 0)
+	},
+}
+
+// rollbackArgs returns the zfs command rolling back to the snapshot
+func rollbackArgs(target *ExtDataset, destroyNewer bool) []string {
+	args := []string{"zfs", "rollback"}
+	if destroyNewer {
+		args = append(args, "-r")
+	}
+	return append(args, target.Name)
+}
+
+// rollbackTarget returns the newest snapshot created at or before t and the
+// snapshots newer than it. Snapshots created at the same time are ordered
+// as listed so the last one wins.
+func rollbackTarget(snapshots []*ExtDataset, t time.Time) (*ExtDataset, []*ExtDataset) {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].Created.After(t) {
+			return snapshots[i], snapshots[i+1:]
+		}
+	}
+	return nil, nil
+}
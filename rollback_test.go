@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	var (
+		at = func(h int) time.Time {
+			return time.Date(2026, 10, 14, h, 0, 0, 0, time.UTC)
+		}
+		a = labeled("hourly", at(1))
+		b = labeled("hourly", at(2))
+		// c and d were taken in the same second, listed by createtxg
+		c         = labeled("a", at(3))
+		d         = labeled("b", at(3))
+		e         = labeled("hourly", at(4))
+		snapshots = []*ExtDataset{a, b, c, d, e}
+	)
+	for _, tc := range []struct {
+		name  string
+		at    time.Time
+		want  *ExtDataset
+		newer []*ExtDataset
+	}{
+		{name: "before the first snapshot", at: at(0)},
+		{name: "after the last snapshot", at: at(5), want: e},
+		{name: "exact match", at: at(2), want: b, newer: []*ExtDataset{c, d, e}},
+		{name: "between snapshots", at: at(2).Add(30 * time.Minute), want: b, newer: []*ExtDataset{c, d, e}},
+		{name: "equal creation times", at: at(3), want: d, newer: []*ExtDataset{e}},
+	} {
+		got, newer := rollbackTarget(snapshots, tc.at)
+		if got != tc.want {
+			t.Errorf("%s: target %v, want %v", tc.name, got, tc.want)
+		}
+		if len(newer) != len(tc.newer) {
+			t.Errorf("%s: %d newer snapshots, want %d", tc.name, len(newer), len(tc.newer))
+			continue
+		}
+		for i := range newer {
+			if newer[i] != tc.newer[i] {
+				t.Errorf("%s: newer %s, want %s", tc.name, newer[i].Name, tc.newer[i].Name)
+			}
+		}
+	}
+	if got, newer := rollbackTarget(nil, at(1)); got != nil || newer != nil {
+		t.Errorf("target %v %v without snapshots", got, newer)
+	}
+}
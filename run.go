@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var runCommand = cli.Command{
+	Name:      "run",
+	Usage:     "snapshot datasets before running a command, optionally rolling back if it fails",
+	ArgsUsage: "<command> [args...]",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "dataset,d",
+			Usage: "dataset to snapshot before the command, repeat for more",
+		},
+		cli.StringFlag{
+			Name:  "label,l",
+			Usage: "label prefixing the pre command snapshot names",
+			Value: "pre-run",
+		},
+		cli.BoolFlag{
+			Name:  "rollback-on-failure",
+			Usage: "rollback the datasets to their snapshot if the command exits non-zero",
+		},
+	},
+	Action: func(clix *cli.Context) error {
+		if clix.NArg() == 0 {
+			return errors.New("no command specified")
+		}
+		datasets := clix.StringSlice("dataset")
+		if len(datasets) == 0 {
+			return errors.New("no dataset specified")
+		}
+		label := clix.String("label")
+		if err := validateLabel(label); err != nil {
+			return err
+		}
+		var (
+			ctx       = appContext(clix)
+			name      = snapshotName(label, time.Now())
+			snapshots []*zfs.Dataset
+		)
+		for _, d := range datasets {
+			if err := validateFullName(d, name); err != nil {
+				return err
+			}
+		}
+		if dryRun(clix) {
+			for _, d := range datasets {
+				fmt.Println(shellJoin([]string{"zfs", "snapshot", d + "@" + name}))
+			}
+			fmt.Println(shellJoin(clix.Args()))
+			return nil
+		}
+		for _, d := range datasets {
+			set, err := zfs.GetDataset(d)
+			if err != nil {
+				return err
+			}
+			s, err := set.Snapshot(name, false)
+			if err != nil {
+				return err
+			}
+			if err := s.SetProperty(labelProp, label); err != nil {
+				return err
+			}
+			logrus.WithField("snapshot", s.Name).Info("snapshot before command")
+			snapshots = append(snapshots, s)
+		}
+		// the command stays in the process group of flux so it can read
+		// the terminal and receives the signals of the foreground job
+		cmd := exec.CommandContext(ctx, clix.Args().First(), clix.Args().Tail()...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+		logrus.WithError(err).WithField("command", clix.Args().First()).Error("command failed")
+		if !clix.Bool("rollback-on-failure") {
+			return err
+		}
+		var failed []string
+		for _, s := range snapshots {
+			logrus.WithField("snapshot", s.Name).Warn("rolling back after failed command")
+			if rerr := s.Rollback(false); rerr != nil {
+				logrus.WithError(rerr).WithField("snapshot", s.Name).Error("unable to rollback")
+				failed = append(failed, s.Name)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("%w, rollback failed for %s, datasets are left as the command left them", err, strings.Join(failed, ", "))
+		}
+		return fmt.Errorf("%w, rolled back", err)
+	},
+}
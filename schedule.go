@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var scheduleFlag = cli.StringFlag{
+	Name:  "schedule",
+	Usage: "schedules as label=interval:keep (hourly=1h:24,daily=24h:14), each sets the snapshot label, min interval and retention tier",
+}
+
+// schedule is a named snapshot interval and the number of its snapshots kept
+type schedule struct {
+	Name  string
+	Every time.Duration
+	Keep  int
+}
+
+// parseSchedules parses label=interval:keep schedules separated by commas
+func parseSchedules(s string) ([]schedule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var (
+		schedules []schedule
+		seen      = make(map[string]bool)
+	)
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid schedule %q, expected label=interval:keep", field)
+		}
+		name := parts[0]
+		if name == "" {
+			return nil, errors.New("schedule name cannot be empty")
+		}
+		if err := validateLabel(name); err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate schedule %q", name)
+		}
+		seen[name] = true
+		spec := strings.SplitN(parts[1], ":", 2)
+		if len(spec) != 2 {
+			return nil, fmt.Errorf("invalid schedule %q, expected label=interval:keep", field)
+		}
+		every, err := time.ParseDuration(spec[0])
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("invalid interval %q for schedule %s", spec[0], name)
+		}
+		keep, err := strconv.Atoi(spec[1])
+		if err != nil || keep < 1 {
+			return nil, fmt.Errorf("invalid keep %q for schedule %s", spec[1], name)
+		}
+		schedules = append(schedules, schedule{
+			Name:  name,
+			Every: every,
+			Keep:  keep,
+		})
+	}
+	return schedules, nil
+}
+
+// expand returns an entry for each schedule of the entry, labeled by the
+// schedule and keeping its snapshots in the retention tier of the label
+func (e datasetEntry) expand() []datasetEntry {
+	if len(e.Schedules) == 0 {
+		return []datasetEntry{e}
+	}
+	var out []datasetEntry
+	for _, s := range e.Schedules {
+		c := e
+		c.Schedules = nil
+		c.Label = s.Name
+		c.MinInterval = s.Every
+		c.Retention = map[string]int{s.Name: s.Keep}
+		out = append(out, c)
+	}
+	return out
+}
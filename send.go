@@ -0,0 +1,896 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// replicatedProps are checked on the destination after a send with props
+var replicatedProps = []string{"compression", "recordsize"}
+
+// sendOpts are the options for sending a snapshot
+type sendOpts struct {
+	// state persists resume tokens of interrupted sends and makes
+	// the recv resumable (zfs recv -s) when set
+	state stateDir
+	// props includes the dataset properties in the stream (zfs send -p)
+	props bool
+	// largeBlocks keeps blocks larger than 128k intact (zfs send -L).
+	// Avoids splitting large records at the cost of requiring large_blocks
+	// on the receiving pool.
+	largeBlocks bool
+	// embed sends embedded data blocks as-is (zfs send -e).
+	// Smaller streams for datasets with many tiny files but the
+	// receiving pool must have embedded_data enabled.
+	embed bool
+	// compressed sends blocks compressed as they are on disk (zfs send -c).
+	// Saves cpu and bandwidth by skipping decompression on send, but the
+	// stream is only as small as the on disk compression.
+	compressed bool
+	// intermediates sends every snapshot between prev and the snapshot
+	// (zfs send -I) instead of a single incremental
+	intermediates bool
+	// checkKeys reports whether the encrypted replica can be unlocked after a send
+	checkKeys bool
+	// progress counts the bytes sent when set
+	progress *progress
+	// sent counts the bytes sent for the caller when set
+	sent *byteCounter
+	// setProps are the property=value pairs set on the destination after a recv
+	setProps []string
+	// onPartial is the action for a partial recv found on the destination
+	onPartial string
+	// compress compresses the stream over ssh when set
+	compress *streamCompressor
+	// compressThreshold is the estimated stream size below which the
+	// stream is sent uncompressed
+	compressThreshold uint64
+	// redact is the redaction bookmark the stream is sent with
+	redact string
+	// mbufferPort, when set, streams to an mbuffer listening on the port
+	// of mbufferAddr instead of through ssh
+	mbufferPort int
+	mbufferAddr string
+	// sizeTolerance, when set, is the percentage an incremental stream may
+	// differ from the zfs estimate of its size
+	sizeTolerance float64
+	// via, when set, carries the stream instead of the transport built
+	// from the flags
+	via transport
+	// holdTag, when set, holds the snapshot with the tag until it was
+	// received so that it survives retries of a resumable send
+	holdTag string
+}
+
+// streamFlags select the features of the send stream
+var streamFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "send-props",
+		Usage: "include dataset properties in the send stream",
+	},
+	cli.BoolFlag{
+		Name:  "large-blocks",
+		Usage: "send blocks larger than 128k as-is, requires large_blocks on both pools",
+	},
+	cli.BoolFlag{
+		Name:  "embed",
+		Usage: "send embedded data blocks as-is, requires embedded_data on both pools",
+	},
+	cli.BoolFlag{
+		Name:  "compressed-stream",
+		Usage: "send blocks as compressed on disk, lowers cpu and bandwidth but relies on the dataset compression",
+	},
+	cli.StringFlag{
+		Name:  "redact",
+		Usage: "redaction bookmark (name after the #) hiding the blocks it redacts from the stream, requires OpenZFS 2.0 on both ends",
+	},
+}
+
+// newSendOpts returns the send options from the stream flags
+func newSendOpts(clix *cli.Context) sendOpts {
+	return sendOpts{
+		state:             stateDir(clix.GlobalString("state-dir")),
+		props:             clix.Bool("send-props"),
+		largeBlocks:       clix.Bool("large-blocks"),
+		embed:             clix.Bool("embed"),
+		compressed:        clix.Bool("compressed-stream"),
+		checkKeys:         clix.Bool("check-keys"),
+		setProps:          clix.StringSlice("set-prop"),
+		onPartial:         clix.String("on-partial"),
+		compress:          newCompressor(clix.String("compress"), clix.String("compress-cmd"), clix.String("decompress-cmd")),
+		compressThreshold: clix.Uint64("compress-threshold"),
+		redact:            clix.String("redact"),
+		mbufferPort:       clix.Int("mbuffer-port"),
+		mbufferAddr:       clix.String("mbuffer-addr"),
+		sizeTolerance:     clix.Float64("size-tolerance"),
+	}
+}
+
+func (o sendOpts) args(name string, prev *ExtDataset) []string {
+	args := []string{"send"}
+	if o.props {
+		args = append(args, "-p")
+	}
+	if o.largeBlocks {
+		args = append(args, "-L")
+	}
+	if o.embed {
+		args = append(args, "-e")
+	}
+	if o.compressed {
+		args = append(args, "-c")
+	}
+	if o.redact != "" {
+		args = append(args, "--redact", o.redactBookmark(name))
+	}
+	if prev != nil {
+		flag := "-i"
+		if o.intermediates {
+			flag = "-I"
+		}
+		args = append(args, flag, prev.Name)
+	}
+	return append(args, name)
+}
+
+func (o sendOpts) recvArgs(dest string) []string {
+	args := []string{"recv"}
+	if o.state != "" {
+		args = append(args, "-s")
+	}
+	return append(args, dest)
+}
+
+// features returns the pool features both ends need for the stream
+func (o sendOpts) features() []string {
+	var features []string
+	if o.largeBlocks {
+		features = append(features, "large_blocks")
+	}
+	if o.embed {
+		features = append(features, "embedded_data")
+	}
+	if o.compressed {
+		features = append(features, "lz4_compress")
+	}
+	if o.redact != "" {
+		features = append(features, "redaction_bookmarks", "redacted_datasets")
+	}
+	return features
+}
+
+// redactBookmark returns the full name of the redaction bookmark of the
+// dataset of the snapshot
+func (o sendOpts) redactBookmark(snapshot string) string {
+	if strings.Contains(o.redact, "#") {
+		return o.redact
+	}
+	return baseName(snapshot) + "#" + o.redact
+}
+
+// checkBookmark ensures the bookmark exists so a missing redaction
+// bookmark is reported before the stream starts
+func checkBookmark(ctx context.Context, name string) error {
+	if _, err := zfsOutput(ctx, "list", "-H", "-t", "bookmark", "-o", "name", name); err != nil {
+		return fmt.Errorf("redaction bookmark %s: %w", name, err)
+	}
+	return nil
+}
+
+// remoteFlags select the ssh target and destination for commands
+// operating on a remote destination
+var remoteFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "send,s",
+		Usage: "ssh target holding the destination",
+	},
+	cli.StringFlag{
+		Name:  "dest,d",
+		Usage: "destination",
+	},
+	cli.UintFlag{
+		Name:  "uid",
+		Usage: "ssh user",
+	},
+	cli.UintFlag{
+		Name:  "gid",
+		Usage: "ssh group",
+	},
+	sshBinFlag,
+	remoteZFSFlag,
+	targetUserFlag,
+	targetHostKeyFlag,
+}
+
+var targetUserFlag = cli.StringFlag{
+	Name:  "target-user",
+	Usage: "remote user to ssh as, for targets without a user@, independent of the local --uid",
+}
+
+// validateTargetUser ensures the remote user cannot be taken for an ssh option
+func validateTargetUser(user string) error {
+	if user == "" {
+		return nil
+	}
+	if strings.HasPrefix(user, "-") || strings.ContainsAny(user, "@: \t") {
+		return fmt.Errorf("invalid target user %q", user)
+	}
+	return nil
+}
+
+// targetWithUser returns the ssh target as user@host unless it already
+// names a user
+func targetWithUser(target, user string) string {
+	if user == "" || strings.Contains(target, "@") {
+		return target
+	}
+	return user + "@" + target
+}
+
+var sshBinFlag = cli.StringFlag{
+	Name:  "ssh-bin",
+	Usage: "ssh binary or wrapper used to reach the remote",
+	Value: "ssh",
+}
+
+var remoteZFSFlag = cli.StringFlag{
+	Name:  "remote-zfs",
+	Usage: "path of zfs on the remote (/usr/local/sbin/zfs)",
+	Value: "zfs",
+}
+
+var checkKeysFlag = cli.BoolFlag{
+	Name:  "check-keys",
+	Usage: "report if the encrypted replica on the destination is locked after the send",
+}
+
+var recvCmdFlag = cli.StringFlag{
+	Name:  "recv-cmd",
+	Usage: "remote shell command wrapping the recv, {recv} is replaced by the zfs recv and {dest} by the destination (zstd -d | {recv})",
+}
+
+// newRemote returns the remote for the target using the ssh flags
+func newRemote(clix *cli.Context, target string) *remote {
+	return &remote{
+		target:  targetWithUser(target, clix.String("target-user")),
+		uid:     uint32(clix.Uint("uid")),
+		gid:     uint32(clix.Uint("gid")),
+		recvCmd: clix.String("recv-cmd"),
+		sshBin:  clix.String("ssh-bin"),
+		zfsBin:  clix.String("remote-zfs"),
+		hostKey: clix.String("target-host-key"),
+	}
+}
+
+// validateRecvCmd ensures the recv command template runs the recv
+func validateRecvCmd(tmpl string) error {
+	if tmpl != "" && !strings.Contains(tmpl, "{recv}") {
+		return fmt.Errorf("recv-cmd %q does not contain {recv}", tmpl)
+	}
+	return nil
+}
+
+// remote is an ssh target that commands are run on
+type remote struct {
+	target string
+	uid    uint32
+	gid    uint32
+	// recvCmd is the template of the remote shell command running the recv
+	recvCmd string
+	// sshBin is the local ssh binary, ssh when empty
+	sshBin string
+	// zfsBin is the zfs binary on the remote, zfs when empty
+	zfsBin string
+	// controlPath is the socket of the shared master connection when
+	// multiplexing
+	controlPath string
+	// hostKey is the only host key accepted from the target when set
+	hostKey string
+}
+
+func (r *remote) String() string {
+	return r.target
+}
+
+// args returns the ssh arguments to run name with args on the remote host
+func (r *remote) args(name string, args ...string) []string {
+	return append([]string{r.target, name}, args...)
+}
+
+// command returns a command that runs name with args on the remote host
+func (r *remote) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return r.ssh(ctx, r.args(name, args...)...)
+}
+
+// zfs returns a command that runs zfs with args on the remote host
+func (r *remote) zfs(ctx context.Context, args ...string) *exec.Cmd {
+	return r.command(ctx, r.zfsPath(), args...)
+}
+
+func (r *remote) zfsPath() string {
+	if r.zfsBin == "" {
+		return "zfs"
+	}
+	return r.zfsBin
+}
+
+func (r *remote) sshPath() string {
+	if r.sshBin == "" {
+		return "ssh"
+	}
+	return r.sshBin
+}
+
+// sshArgs returns the arguments of ssh with the options of the remote
+// before args
+func (r *remote) sshArgs(args ...string) []string {
+	if r.hostKey != "" {
+		args = append(hostKeyArgs(pinnedKnownHosts(r)), args...)
+	}
+	if r.controlPath != "" {
+		args = append([]string{
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath=" + r.controlPath,
+			"-o", "ControlPersist=yes",
+		}, args...)
+	}
+	return args
+}
+
+// recvCommand returns the command running the recv on the remote host,
+// wrapped by the recv command template when set
+func (r *remote) recvCommand(ctx context.Context, recvArgs []string) *exec.Cmd {
+	return r.ssh(ctx, r.recvArgs(recvArgs)...)
+}
+
+// recvArgs returns the ssh arguments running the recv on the remote host
+func (r *remote) recvArgs(recvArgs []string) []string {
+	if r.recvCmd == "" {
+		return r.args(r.zfsPath(), recvArgs...)
+	}
+	return []string{r.target, r.recvShell(recvArgs)}
+}
+
+// recvLine returns the remote shell command running the recv
+func (r *remote) recvLine(recvArgs []string) string {
+	if r.recvCmd == "" {
+		return shellJoin(append([]string{r.zfsPath()}, recvArgs...))
+	}
+	return r.recvShell(recvArgs)
+}
+
+// recvShell returns the remote shell command of the recv template with
+// the placeholders replaced by their quoted values
+func (r *remote) recvShell(recvArgs []string) string {
+	return strings.NewReplacer(
+		"{recv}", shellJoin(append([]string{r.zfsPath()}, recvArgs...)),
+		"{dest}", shellJoin(recvArgs[len(recvArgs)-1:]),
+	).Replace(r.recvCmd)
+}
+
+func (r *remote) ssh(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := command(ctx, r.sshPath(), r.sshArgs(args...)...)
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: r.uid,
+		Gid: r.gid,
+	}
+	return cmd
+}
+
+func send(ctx context.Context, r *remote, dest string, opts sendOpts, set *zfs.Dataset, prev *ExtDataset) error {
+	if err := checkVersions(ctx, r, opts); err != nil {
+		return err
+	}
+	if err := checkFeatures(ctx, r, poolName(set.Name), poolName(dest), opts.features()); err != nil {
+		return err
+	}
+	if opts.redact != "" {
+		if err := checkBookmark(ctx, opts.redactBookmark(set.Name)); err != nil {
+			return err
+		}
+	}
+	if err := handlePartial(ctx, r, dest, opts, set); err != nil {
+		return err
+	}
+	if err := holdSent(ctx, opts.holdTag, set.Name); err != nil {
+		return fmt.Errorf("hold %s for the send: %w", set.Name, err)
+	}
+	if opts.state != "" {
+		if err := resumeSend(ctx, r, dest, opts, set); err != nil {
+			updateResumeToken(ctx, r, dest, opts.state, set)
+			return err
+		}
+	}
+	var (
+		sent     = &byteCounter{n: new(int64)}
+		sendArgs = opts.args(set.Name, prev)
+		compress = useCompression(ctx, opts, sendArgs)
+		t        = opts.transport(ctx, r, compress)
+	)
+	if err := transfer(ctx, t, opts.recvArgs(dest), sendArgs, compress, opts.progress.counter(baseName(set.Name)), sent, opts.sent); err != nil {
+		if opts.state != "" {
+			updateResumeToken(ctx, r, dest, opts.state, set)
+		}
+		return err
+	}
+	if opts.state != "" {
+		recordTransfer(opts.state, transferRecord{
+			Time:    time.Now(),
+			Target:  r.target,
+			Dataset: baseName(set.Name),
+			Dest:    dest,
+			Bytes:   sent.bytes(),
+		})
+	}
+	// compressed streams are counted as sent over the wire
+	if opts.sizeTolerance > 0 && prev != nil && compress == nil {
+		checkStreamSize(ctx, sendArgs, sent.bytes(), opts.sizeTolerance)
+	}
+	releaseStaleSends(ctx, opts.holdTag, baseName(set.Name), "")
+	markSent(ctx, set.Name)
+	if opts.props {
+		verifyProps(ctx, r, baseName(set.Name), dest)
+	}
+	if err := setDestProps(ctx, r, dest, opts.setProps); err != nil {
+		return destPropsError{err}
+	}
+	if opts.checkKeys {
+		checkKeys(ctx, r, dest)
+	}
+	return nil
+}
+
+// markSent records the snapshot as the last sent of its dataset for
+// purge --only-if-sent, failing to record only keeps more snapshots
+func markSent(ctx context.Context, snapshot string) {
+	if err := command(ctx, "zfs", "set", lastSentProp+"="+shortName(snapshot), baseName(snapshot)).Run(); err != nil {
+		logrus.WithError(err).WithField("snapshot", snapshot).Warn("record last sent snapshot")
+	}
+}
+
+// transport carries a send stream to the zfs recv on the destination
+type transport interface {
+	// start starts the recv and returns the writer of the stream along
+	// with a func waiting for the recv once the writer is closed
+	start(ctx context.Context, recvArgs []string) (io.WriteCloser, func() error, error)
+	// String names the destination host in logs
+	String() string
+}
+
+// start runs the recv over ssh reading the stream from its stdin
+func (r *remote) start(ctx context.Context, recvArgs []string) (io.WriteCloser, func() error, error) {
+	ssh := r.recvCommand(ctx, recvArgs)
+	in, err := ssh.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	ssh.Stderr = os.Stderr
+	ssh.Stdout = os.Stdout
+	if err := ssh.Start(); err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	return in, ssh.Wait, nil
+}
+
+// transport returns the transport of the stream to the remote, behind
+// the decompressor when the stream is compressed
+func (o sendOpts) transport(ctx context.Context, r *remote, compress *streamCompressor) transport {
+	if o.via != nil {
+		return o.via
+	}
+	if compress != nil {
+		r = decompressRemote(r, compress)
+	}
+	if o.mbufferPort > 0 {
+		return newMbuffer(ctx, r, o.mbufferAddr, o.mbufferPort)
+	}
+	return r
+}
+
+// transfer pipes a local zfs send with sendArgs into a zfs recv with recvArgs
+// over the transport. zfs is shelled out to so that flags not exposed by
+// go-zfs can be used
+func transfer(ctx context.Context, t transport, recvArgs, sendArgs []string, compress *streamCompressor, counters ...*byteCounter) error {
+	in, recvWait, err := t.start(ctx, recvArgs)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var (
+		w    io.Writer = in
+		wait           = func() error { return nil }
+	)
+	for _, c := range counters {
+		w = c.wrap(w)
+	}
+	if compress != nil {
+		if w, wait, err = compressor(ctx, compress, w); err != nil {
+			in.Close()
+			recvWait()
+			return err
+		}
+	}
+	err = zfsSend(ctx, sendArgs, w)
+	if werr := wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		in.Close()
+		recvWait()
+		if ctx.Err() != nil {
+			logrus.WithFields(logrus.Fields{
+				"target": t.String(),
+				"dest":   recvArgs[len(recvArgs)-1],
+			}).Warn("send interrupted, destination may have a partial recv to resume or abort with zfs recv -A")
+		}
+		return err
+	}
+	in.Close()
+	return recvWait()
+}
+
+// pipeline returns the shell pipeline equivalent to the transfer to the
+// remote, built like the transport of a send without probing the remote.
+// The known_hosts files of pinned host keys are kept for the printed
+// commands.
+func (o sendOpts) pipeline(r *remote, recvArgs, sendArgs []string) string {
+	send := shellJoin(append([]string{"zfs"}, sendArgs...))
+	if o.compress != nil {
+		send += " | " + shellJoin(o.compress.compress)
+		r = decompressRemote(r, o.compress)
+	}
+	if r.hostKey != "" {
+		keepPinnedKeys()
+	}
+	if o.mbufferPort > 0 {
+		m := &mbuffer{r: r, addr: mbufferHost(r, o.mbufferAddr), port: o.mbufferPort}
+		return m.pipeline(send, recvArgs)
+	}
+	return send + " | " + r.sshLine(r.recvArgs(recvArgs)...)
+}
+
+// sshLine returns the shell command running ssh with args to the remote
+func (r *remote) sshLine(args ...string) string {
+	return shellJoin(append([]string{r.sshPath()}, r.sshArgs(args...)...))
+}
+
+// zfsSend writes the stream of zfs send with args to w
+var zfsSend = func(ctx context.Context, args []string, w io.Writer) error {
+	cmd := command(ctx, "zfs", args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// resumeState is the saved resume token of an interrupted send
+type resumeState struct {
+	Dataset string `json:"dataset"`
+	Target  string `json:"target"`
+	Dest    string `json:"dest"`
+	Token   string `json:"token"`
+}
+
+func resumeStateName(dataset, target string) string {
+	return url.PathEscape(dataset) + "@" + url.PathEscape(target) + ".resume.json"
+}
+
+// resumeSend completes an interrupted send from a saved resume token
+// before a new send is made to the destination
+func resumeSend(ctx context.Context, r *remote, dest string, opts sendOpts, set *zfs.Dataset) error {
+	var (
+		state resumeState
+		name  = resumeStateName(baseName(set.Name), r.target)
+	)
+	ok, err := opts.state.load(name, &state)
+	if err != nil {
+		return err
+	}
+	if !ok || state.Dest != dest {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"dataset": state.Dataset,
+		"target":  state.Target,
+	}).Info("resuming interrupted send")
+	if err := resumeToken(ctx, r, dest, opts, set, state.Token); err != nil {
+		return err
+	}
+	// the resumed snapshot is received, only the one about to be sent
+	// stays held
+	releaseStaleSends(ctx, opts.holdTag, baseName(set.Name), set.Name)
+	return opts.state.remove(name)
+}
+
+// resumeToken completes the partial recv on the destination from its token
+func resumeToken(ctx context.Context, r *remote, dest string, opts sendOpts, set *zfs.Dataset, token string) error {
+	compress := opts.compress
+	return transfer(ctx, opts.transport(ctx, r, compress), opts.recvArgs(dest), []string{"send", "-t", token}, compress, opts.progress.counter(baseName(set.Name)))
+}
+
+// onPartialModes are the --on-partial actions for a partial recv found on
+// the destination before a send
+var onPartialModes = map[string]bool{
+	"":       true,
+	"resume": true,
+	"abort":  true,
+}
+
+var onPartialFlag = cli.StringFlag{
+	Name:  "on-partial",
+	Usage: "resume or abort (zfs recv -A) a partial recv left on the destination by an interrupted send",
+}
+
+func validateOnPartial(mode string) error {
+	if !onPartialModes[mode] {
+		return fmt.Errorf("unknown on-partial action %q", mode)
+	}
+	return nil
+}
+
+// handlePartial resumes or aborts a partial recv left on the destination,
+// which otherwise blocks new receives into it
+func handlePartial(ctx context.Context, r *remote, dest string, opts sendOpts, set *zfs.Dataset) error {
+	if opts.onPartial == "" {
+		return nil
+	}
+	token, err := remoteResumeToken(ctx, r, dest)
+	if err != nil {
+		// a destination that does not exist yet has no partial recv
+		logrus.WithError(err).WithField("dest", dest).Debug("get resume token")
+		return nil
+	}
+	if token == "" {
+		return nil
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"target": r.target,
+		"dest":   dest,
+	})
+	switch opts.onPartial {
+	case "resume":
+		log.Info("resuming partial recv on destination")
+		if err := resumeToken(ctx, r, dest, opts, set, token); err != nil {
+			return err
+		}
+		releaseStaleSends(ctx, opts.holdTag, baseName(set.Name), set.Name)
+	case "abort":
+		log.Warn("aborting partial recv on destination")
+		if err := r.zfs(ctx, "recv", "-A", dest).Run(); err != nil {
+			return fmt.Errorf("abort partial recv on %s: %w", dest, err)
+		}
+	}
+	if opts.state != "" {
+		return opts.state.remove(resumeStateName(baseName(set.Name), r.target))
+	}
+	return nil
+}
+
+// remoteResumeToken returns the resume token of a partial recv on the
+// destination, empty without one
+func remoteResumeToken(ctx context.Context, r *remote, dest string) (string, error) {
+	props, err := getProps(r.zfs(ctx, "get", "-H", "-o", "property,value", "receive_resume_token", dest))
+	if err != nil {
+		return "", err
+	}
+	if token := props["receive_resume_token"]; token != "-" {
+		return token, nil
+	}
+	return "", nil
+}
+
+// updateResumeToken stores the resume token left on the destination by
+// an interrupted recv so that the next run can resume it. A saved token is
+// removed if the destination no longer has one and kept if it is unreachable.
+func updateResumeToken(ctx context.Context, r *remote, dest string, state stateDir, set *zfs.Dataset) {
+	if ctx.Err() != nil {
+		// the destination cannot be queried once interrupted, keep any saved token
+		return
+	}
+	token, err := remoteResumeToken(ctx, r, dest)
+	if err != nil {
+		logrus.WithError(err).Error("get resume token")
+		return
+	}
+	var (
+		dataset = baseName(set.Name)
+		name    = resumeStateName(dataset, r.target)
+	)
+	if token == "" {
+		if err := state.remove(name); err != nil {
+			logrus.WithError(err).Error("remove resume token")
+		}
+		return
+	}
+	if err := state.save(name, &resumeState{
+		Dataset: dataset,
+		Target:  r.target,
+		Dest:    dest,
+		Token:   token,
+	}); err != nil {
+		logrus.WithError(err).Error("save resume token")
+	}
+}
+
+var setPropFlag = cli.StringSliceFlag{
+	Name:  "set-prop",
+	Usage: "property=value set on the destination after a successful recv, repeat for more, only blocks written afterwards follow it",
+}
+
+func validateSetProps(props []string) error {
+	for _, p := range props {
+		if kv := strings.SplitN(p, "=", 2); len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid property %q, expected property=value", p)
+		}
+	}
+	return nil
+}
+
+// setDestProps sets the properties on the destination, trying all of them
+// before reporting the ones that failed
+func setDestProps(ctx context.Context, r *remote, dest string, props []string) error {
+	var failed []string
+	for _, p := range props {
+		// ssh hands the arguments to the remote shell, values may hold
+		// spaces or shell characters
+		if err := r.zfs(ctx, "set", shellJoin([]string{p}), shellJoin([]string{dest})).Run(); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"dest":     dest,
+				"property": p,
+			}).Error("set destination property")
+			failed = append(failed, p)
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"dest":     dest,
+			"property": p,
+		}).Debug("set destination property")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to set %s on %s", strings.Join(failed, ","), dest)
+	}
+	return nil
+}
+
+// verifyProps warns when the replicated properties on the destination
+// do not match the source after a send with props
+func verifyProps(ctx context.Context, r *remote, source, dest string) {
+	args := []string{"get", "-H", "-p", "-o", "property,value", strings.Join(replicatedProps, ",")}
+	local, err := getProps(command(ctx, "zfs", append(args, source)...))
+	if err != nil {
+		logrus.WithError(err).Error("get local properties")
+		return
+	}
+	dst, err := getProps(r.zfs(ctx, append(args, dest)...))
+	if err != nil {
+		logrus.WithError(err).Error("get remote properties")
+		return
+	}
+	for _, p := range replicatedProps {
+		if local[p] != dst[p] {
+			logrus.WithFields(logrus.Fields{
+				"property": p,
+				"source":   local[p],
+				"dest":     dst[p],
+			}).Warn("property mismatch after send")
+		}
+	}
+}
+
+// checkKeys reports whether the encrypted replica on the destination can be
+// unlocked after the recv. Raw sends keep the source encryption so the
+// replica stays locked until its key is loaded on the destination.
+func checkKeys(ctx context.Context, r *remote, dest string) {
+	props, err := getProps(r.zfs(ctx, "get", "-H", "-o", "property,value", "encryption,keystatus,keylocation,encryptionroot", dest))
+	if err != nil {
+		logrus.WithError(err).Error("get remote encryption properties")
+		return
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"dest":           dest,
+		"encryption":     props["encryption"],
+		"keystatus":      props["keystatus"],
+		"keylocation":    props["keylocation"],
+		"encryptionroot": props["encryptionroot"],
+	})
+	switch {
+	case props["encryption"] == "" || props["encryption"] == "off":
+		log.Debug("replica is not encrypted")
+	case props["keystatus"] == "available":
+		log.Info("replica key is loaded")
+	case props["keylocation"] == "prompt":
+		log.Warn("replica is locked, its key has to be entered with zfs load-key on the destination")
+	default:
+		log.Warn("replica is locked, load its key with zfs load-key on the destination")
+	}
+}
+
+// checkFeatures ensures the pool features required for the stream are enabled
+// on both the source and destination pools so that a mismatch is reported
+// before a recv fails
+func checkFeatures(ctx context.Context, r *remote, source, dest string, features []string) error {
+	if len(features) == 0 {
+		return nil
+	}
+	var props []string
+	for _, f := range features {
+		props = append(props, "feature@"+f)
+	}
+	args := []string{"get", "-H", "-o", "property,value", strings.Join(props, ",")}
+	local, err := getProps(command(ctx, "zpool", append(args, source)...))
+	if err != nil {
+		return fmt.Errorf("get features for pool %s: %w", source, err)
+	}
+	dst, err := getProps(r.command(ctx, "zpool", append(args, dest)...))
+	if err != nil {
+		return fmt.Errorf("get features for remote pool %s: %w", dest, err)
+	}
+	for _, p := range props {
+		if !featureEnabled(local[p]) {
+			return fmt.Errorf("%s is not supported by source pool %s", p, source)
+		}
+		if !featureEnabled(dst[p]) {
+			return fmt.Errorf("%s is not supported by destination pool %s", p, dest)
+		}
+	}
+	return nil
+}
+
+func featureEnabled(v string) bool {
+	return v == "enabled" || v == "active"
+}
+
+func getProps(cmd *exec.Cmd) (map[string]string, error) {
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	props := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		props[fields[0]] = fields[1]
+	}
+	return props, s.Err()
+}
+
+func baseName(name string) string {
+	return strings.Split(name, "@")[0]
+}
+
+func poolName(name string) string {
+	return strings.Split(name, "/")[0]
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9@%+=:,./_-]+$`)
+
+// shellJoin quotes args so they can be pasted into a shell
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if shellSafe.MatchString(a) {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
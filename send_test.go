@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mistifyio/go-zfs"
+)
+
+// fakeTransport records the streams it receives in memory
+type fakeTransport struct {
+	// limit, when set, fails the stream after that many bytes like a
+	// connection lost mid transfer
+	limit int
+	// startErr fails the recv before it starts
+	startErr error
+
+	recvArgs [][]string
+	streams  []bytes.Buffer
+}
+
+var errConnectionLost = errors.New("connection lost")
+
+type fakeStream struct {
+	t   *fakeTransport
+	buf *bytes.Buffer
+}
+
+func (s fakeStream) Write(p []byte) (int, error) {
+	if s.t.limit > 0 && s.buf.Len()+len(p) > s.t.limit {
+		n := s.t.limit - s.buf.Len()
+		s.buf.Write(p[:n])
+		return n, errConnectionLost
+	}
+	return s.buf.Write(p)
+}
+
+func (s fakeStream) Close() error {
+	return nil
+}
+
+func (t *fakeTransport) start(ctx context.Context, recvArgs []string) (io.WriteCloser, func() error, error) {
+	if t.startErr != nil {
+		return nil, nil, t.startErr
+	}
+	t.recvArgs = append(t.recvArgs, recvArgs)
+	t.streams = append(t.streams, bytes.Buffer{})
+	s := fakeStream{t: t, buf: &t.streams[len(t.streams)-1]}
+	return s, func() error {
+		if t.limit > 0 && s.buf.Len() >= t.limit {
+			return errConnectionLost
+		}
+		return nil
+	}, nil
+}
+
+func (t *fakeTransport) String() string {
+	return "fake"
+}
+
+// fakeSend replaces zfs send with a source writing the stream for its
+// arguments, the sent arguments are recorded
+func fakeSend(t *testing.T) *[][]string {
+	var sent [][]string
+	orig := zfsSend
+	zfsSend = func(ctx context.Context, args []string, w io.Writer) error {
+		sent = append(sent, args)
+		_, err := io.WriteString(w, "stream of "+strings.Join(args, " "))
+		return err
+	}
+	t.Cleanup(func() { zfsSend = orig })
+	return &sent
+}
+
+// fakeHost lists fixed snapshots or fails listing them, the destroys and
+// released holds are recorded
+type fakeHost struct {
+	list    []*ExtDataset
+	listErr error
+	// held are the hold tags of the snapshots by name
+	held map[string][]string
+
+	destroyed []string
+	flags     []zfs.DestroyFlag
+	released  []string
+}
+
+func (h *fakeHost) snapshots(name string, opts listOpts) ([]*ExtDataset, error) {
+	return h.list, h.listErr
+}
+
+func (h *fakeHost) clones(s *ExtDataset) ([]string, error) {
+	return nil, nil
+}
+
+func (h *fakeHost) holds(s *ExtDataset) ([]string, error) {
+	return h.held[s.Name], nil
+}
+
+func (h *fakeHost) release(s *ExtDataset, tag string) error {
+	h.released = append(h.released, s.Name+" "+tag)
+	return nil
+}
+
+func (h *fakeHost) destroy(s *ExtDataset, flags zfs.DestroyFlag) error {
+	h.destroyed = append(h.destroyed, s.Name)
+	h.flags = append(h.flags, flags)
+	return nil
+}
+
+func snap(name string, guid uint64) *ExtDataset {
+	return &ExtDataset{
+		Dataset:  &zfs.Dataset{Name: name},
+		BaseName: baseName(name),
+		GUID:     guid,
+	}
+}
+
+func TestTransferFull(t *testing.T) {
+	var (
+		sent = fakeSend(t)
+		tr   = &fakeTransport{}
+		opts = sendOpts{}
+		n    = &byteCounter{n: new(int64)}
+	)
+	if err := transfer(context.Background(), tr, opts.recvArgs("backup/home"), opts.args("tank/home@b", nil), nil, n); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"send", "tank/home@b"}
+	if !reflect.DeepEqual((*sent)[0], want) {
+		t.Errorf("send args %v, want %v", (*sent)[0], want)
+	}
+	if !reflect.DeepEqual(tr.recvArgs[0], []string{"recv", "backup/home"}) {
+		t.Errorf("recv args %v", tr.recvArgs[0])
+	}
+	stream := tr.streams[0].String()
+	if stream != "stream of send tank/home@b" {
+		t.Errorf("received %q", stream)
+	}
+	if n.bytes() != int64(len(stream)) {
+		t.Errorf("counted %d bytes, received %d", n.bytes(), len(stream))
+	}
+}
+
+func TestTransferIncremental(t *testing.T) {
+	var (
+		sent = fakeSend(t)
+		tr   = &fakeTransport{}
+		opts = sendOpts{}
+	)
+	if err := transfer(context.Background(), tr, opts.recvArgs("backup/home"), opts.args("tank/home@b", snap("tank/home@a", 1)), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"send", "-i", "tank/home@a", "tank/home@b"}
+	if !reflect.DeepEqual((*sent)[0], want) {
+		t.Errorf("send args %v, want %v", (*sent)[0], want)
+	}
+	if got := tr.streams[0].String(); got != "stream of "+strings.Join(want, " ") {
+		t.Errorf("received %q", got)
+	}
+}
+
+func TestTransferIncrementalFallback(t *testing.T) {
+	var (
+		sent = fakeSend(t)
+		tr   = &fakeTransport{}
+		opts = sendOpts{}
+		a    = snap("tank/home@a", 1)
+		b    = snap("tank/home@b", 2)
+		job  = &snapshotJob{
+			entry: datasetEntry{Name: "tank/home", Dest: "backup/home"},
+			set:   &zfs.Dataset{Name: "tank/home"},
+			prev:  b,
+		}
+	)
+	// the destination missed b, the send falls back to the common a
+	prev := job.commonBase(&fakeHost{list: []*ExtDataset{snap("backup/home@a", 1)}}, []*ExtDataset{a, b})
+	if prev != a {
+		t.Fatalf("base %v, want %s", prev, a.Name)
+	}
+	if err := transfer(context.Background(), tr, opts.recvArgs("backup/home"), opts.args("tank/home@c", prev), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"send", "-i", "tank/home@a", "tank/home@c"}
+	if !reflect.DeepEqual((*sent)[0], want) {
+		t.Errorf("send args %v, want %v", (*sent)[0], want)
+	}
+}
+
+func TestTransferFailure(t *testing.T) {
+	fakeSend(t)
+	opts := sendOpts{}
+	start := errors.New("ssh: connect to host backup: connection refused")
+	if err := transfer(context.Background(), &fakeTransport{startErr: start}, opts.recvArgs("backup/home"), opts.args("tank/home@b", nil), nil); err != start {
+		t.Errorf("start failure returned %v", err)
+	}
+	partial := &fakeTransport{limit: 4}
+	if err := transfer(context.Background(), partial, opts.recvArgs("backup/home"), opts.args("tank/home@b", nil), nil); !errors.Is(err, errConnectionLost) {
+		t.Errorf("partial transfer returned %v", err)
+	}
+	if got := partial.streams[0].Len(); got != 4 {
+		t.Errorf("received %d bytes of the partial stream, want 4", got)
+	}
+}
+
+func TestResumeAfterTransientFailure(t *testing.T) {
+	var (
+		sent = fakeSend(t)
+		ctx  = context.Background()
+		r    = &remote{target: "backup"}
+		set  = &zfs.Dataset{Name: "tank/home@b"}
+		opts = sendOpts{state: stateDir(t.TempDir())}
+	)
+	opts.via = &fakeTransport{limit: 4}
+	if err := transfer(ctx, opts.via, opts.recvArgs("backup/home"), opts.args(set.Name, nil), nil); err == nil {
+		t.Fatal("interrupted transfer succeeded")
+	}
+	// the token the failed recv left on the destination is saved
+	name := resumeStateName("tank/home", r.target)
+	if err := opts.state.save(name, &resumeState{Dataset: "tank/home", Target: r.target, Dest: "backup/home", Token: "1-abc"}); err != nil {
+		t.Fatal(err)
+	}
+	retry := &fakeTransport{}
+	opts.via = retry
+	if err := resumeSend(ctx, r, "backup/home", opts, set); err != nil {
+		t.Fatal(err)
+	}
+	if got := (*sent)[len(*sent)-1]; !reflect.DeepEqual(got, []string{"send", "-t", "1-abc"}) {
+		t.Errorf("resumed with %v", got)
+	}
+	if !reflect.DeepEqual(retry.recvArgs[0], []string{"recv", "-s", "backup/home"}) {
+		t.Errorf("resumed recv args %v", retry.recvArgs[0])
+	}
+	if ok, err := opts.state.load(name, &resumeState{}); err != nil || ok {
+		t.Errorf("resume state kept after the resumed send: %v %v", ok, err)
+	}
+}
+
+// fakeCommand puts an executable shell script named name first in the PATH
+// for the test
+func fakeCommand(t *testing.T, name, script string) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRedactBookmark(t *testing.T) {
+	for _, tc := range []struct {
+		redact string
+		want   string
+	}{
+		{redact: "before-secrets", want: "tank/home#before-secrets"},
+		{redact: "tank/home#before-secrets", want: "tank/home#before-secrets"},
+		{redact: "tank/other#shared", want: "tank/other#shared"},
+	} {
+		opts := sendOpts{redact: tc.redact}
+		if got := opts.redactBookmark("tank/home@daily-2026-10-14T00:00:00Z"); got != tc.want {
+			t.Errorf("%s: bookmark %s, want %s", tc.redact, got, tc.want)
+		}
+	}
+	opts := sendOpts{redact: "before-secrets"}
+	want := []string{"send", "--redact", "tank/home#before-secrets", "-i", "tank/home@a", "tank/home@b"}
+	if got := opts.args("tank/home@b", snap("tank/home@a", 1)); !reflect.DeepEqual(got, want) {
+		t.Errorf("send args %v, want %v", got, want)
+	}
+}
+
+func TestCheckBookmark(t *testing.T) {
+	// zfs list -H -t bookmark -o name <bookmark>
+	fakeCommand(t, "zfs", `if [ "$7" = "tank/home#before-secrets" ]; then
+	echo "$7"
+	exit 0
+fi
+echo "cannot open '$7': bookmark does not exist" >&2
+exit 1
+`)
+	if err := checkBookmark(context.Background(), "tank/home#before-secrets"); err != nil {
+		t.Errorf("existing bookmark: %v", err)
+	}
+	err := checkBookmark(context.Background(), "tank/home#missing")
+	if err == nil || !strings.Contains(err.Error(), "bookmark does not exist") {
+		t.Errorf("missing bookmark: %v", err)
+	}
+}
+
+func TestRedactFeatures(t *testing.T) {
+	if got := (sendOpts{}).features(); len(got) != 0 {
+		t.Errorf("features %v without --redact", got)
+	}
+	opts := sendOpts{redact: "before-secrets"}
+	features := opts.features()
+	if want := []string{"redaction_bookmarks", "redacted_datasets"}; !reflect.DeepEqual(features, want) {
+		t.Fatalf("features %v, want %v", features, want)
+	}
+	// the remote runs the command after the target locally
+	fakeCommand(t, "ssh", `while [ "$1" != backup ]; do shift; done
+shift
+exec "$@"
+`)
+	// zpool get -H -o property,value <features> <pool>, the pools list the
+	// features they do not support in $DISABLED
+	fakeCommand(t, "zpool", `for f in $(echo "$5" | tr , ' '); do
+	state=enabled
+	case " $DISABLED " in *" $6:$f "*) state=disabled ;; esac
+	printf '%s\t%s\n' "$f" "$state"
+done
+`)
+	r := &remote{target: "backup", uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+	for _, tc := range []struct {
+		disabled string
+		err      string
+	}{
+		{},
+		{disabled: "tank:feature@redaction_bookmarks", err: "feature@redaction_bookmarks is not supported by source pool tank"},
+		{disabled: "backup:feature@redacted_datasets", err: "feature@redacted_datasets is not supported by destination pool backup"},
+	} {
+		t.Setenv("DISABLED", tc.disabled)
+		err := checkFeatures(context.Background(), r, "tank", "backup", features)
+		if tc.err == "" && err != nil {
+			t.Errorf("all features enabled: %v", err)
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: %v, want %s", tc.disabled, err, tc.err)
+		}
+	}
+}
+
+func TestTargetUser(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		user   string
+		want   string
+	}{
+		{target: "backup", want: "backup"},
+		{target: "backup", user: "flux", want: "flux@backup"},
+		{target: "backup.example.com", user: "flux", want: "flux@backup.example.com"},
+		{target: "root@backup", user: "flux", want: "root@backup"},
+		{target: "root@backup", want: "root@backup"},
+	} {
+		if err := validateTargetUser(tc.user); err != nil {
+			t.Errorf("%s: %v", tc.user, err)
+		}
+		if got := targetWithUser(tc.target, tc.user); got != tc.want {
+			t.Errorf("%s with user %q: %s, want %s", tc.target, tc.user, got, tc.want)
+		}
+	}
+	for _, user := range []string{"-oProxyCommand=sh", "-l", "flux@backup", "flux:x", "flux backup", "flux\tx"} {
+		if err := validateTargetUser(user); err == nil {
+			t.Errorf("accepted target user %q", user)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	sendArgs := []string{"send", "-i", "tank/home@a", "tank/home@b"}
+	for _, tc := range []struct {
+		name string
+		opts sendOpts
+		r    remote
+		want string
+	}{
+		{
+			name: "ssh",
+			r:    remote{target: "root@backup"},
+			want: "zfs send -i tank/home@a tank/home@b | ssh root@backup zfs recv backup/home",
+		},
+		{
+			name: "recv command",
+			r:    remote{target: "backup", recvCmd: "sudo {recv}", zfsBin: "/usr/local/sbin/zfs"},
+			want: "zfs send -i tank/home@a tank/home@b | ssh backup 'sudo /usr/local/sbin/zfs recv backup/home'",
+		},
+		{
+			name: "compress",
+			opts: sendOpts{compress: newCompressor("zstd", "", "")},
+			r:    remote{target: "backup", sshBin: "/usr/bin/ssh"},
+			want: "zfs send -i tank/home@a tank/home@b | zstd -c | /usr/bin/ssh backup 'zstd -dc | zfs recv backup/home'",
+		},
+		{
+			name: "compress command",
+			opts: sendOpts{compress: newCompressor("", "zstd -T0 -3", "zstd -d")},
+			r:    remote{target: "backup", recvCmd: "nice {recv}"},
+			want: "zfs send -i tank/home@a tank/home@b | zstd -T0 -3 | ssh backup 'nice zstd -d | zfs recv backup/home'",
+		},
+		{
+			name: "mbuffer",
+			opts: sendOpts{mbufferPort: 9090, compress: newCompressor("lz4", "", "")},
+			r:    remote{target: "root@backup"},
+			want: "ssh root@backup 'mbuffer -q -m 1G -I 9090 | lz4 -dc | zfs recv backup/home' & zfs send -i tank/home@a tank/home@b | lz4 -c | mbuffer -q -O backup:9090",
+		},
+		{
+			name: "mbuffer address",
+			opts: sendOpts{mbufferPort: 9090, mbufferAddr: "10.0.0.2"},
+			r:    remote{target: "backup"},
+			want: "ssh backup 'mbuffer -q -m 1G -I 9090 | zfs recv backup/home' & zfs send -i tank/home@a tank/home@b | mbuffer -q -O 10.0.0.2:9090",
+		},
+		{
+			name: "control path",
+			r:    remote{target: "backup", controlPath: "/tmp/flux-ssh/%C"},
+			want: "zfs send -i tank/home@a tank/home@b | ssh -o ControlMaster=auto -o ControlPath=/tmp/flux-ssh/%C -o ControlPersist=yes backup zfs recv backup/home",
+		},
+	} {
+		if got := tc.opts.pipeline(&tc.r, []string{"recv", "backup/home"}, sendArgs); got != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPipelineHostKey(t *testing.T) {
+	defer func() {
+		pinnedKeys.keep = false
+		removePinnedKeys()
+	}()
+	r := &remote{target: "backup", hostKey: "ssh-ed25519 " + testKeyBlob, uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+	got := sendOpts{}.pipeline(r, []string{"recv", "backup/home"}, []string{"send", "tank/home@b"})
+	known := pinnedKnownHosts(r)
+	want := "zfs send tank/home@b | ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + known + " -o GlobalKnownHostsFile=/dev/null -o HostKeyAlias=" + pinnedHostAlias + " backup zfs recv backup/home"
+	if got != want {
+		t.Errorf("\n got %s\nwant %s", got, want)
+	}
+	// the printed command needs the known hosts file after flux exits
+	removePinnedKeys()
+	if _, err := os.Stat(known); err != nil {
+		t.Errorf("known hosts file of the printed command removed: %v", err)
+	}
+}
+
+func TestRecvLine(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		r    remote
+		args []string
+		want string
+	}{
+		{
+			name: "plain recv",
+			args: []string{"recv", "-F", "backup/home"},
+			want: "zfs recv -F backup/home",
+		},
+		{
+			name: "quoted dest",
+			args: []string{"recv", "-F", "backup/my home"},
+			want: "zfs recv -F 'backup/my home'",
+		},
+		{
+			name: "template",
+			r:    remote{recvCmd: "zstd -d | {recv}", zfsBin: "/sbin/zfs"},
+			args: []string{"recv", "-F", "backup/home"},
+			want: "zstd -d | /sbin/zfs recv -F backup/home",
+		},
+		{
+			name: "template with quoted dest",
+			r:    remote{recvCmd: "zfs-lock {dest} {recv}"},
+			args: []string{"recv", "-F", "backup/it's mine"},
+			want: `zfs-lock 'backup/it'\''s mine' zfs recv -F 'backup/it'\''s mine'`,
+		},
+		{
+			name: "template without recv",
+			r:    remote{recvCmd: "sudo zfs recv -F {dest}"},
+			args: []string{"recv", "-F", "backup/my home"},
+			want: "sudo zfs recv -F 'backup/my home'",
+		},
+	} {
+		if got := tc.r.recvLine(tc.args); got != tc.want {
+			t.Errorf("%s: recv line %q, want %q", tc.name, got, tc.want)
+		}
+		if tc.r.recvCmd == "" {
+			continue
+		}
+		if got := tc.r.recvShell(tc.args); got != tc.want {
+			t.Errorf("%s: recv shell %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if err := validateRecvCmd("sudo zfs recv -F {dest}"); err == nil {
+		t.Error("recv-cmd without {recv} accepted")
+	}
+	if err := validateRecvCmd("zstd -d | {recv}"); err != nil {
+		t.Errorf("recv-cmd rejected: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var sendCommand = cli.Command{
+	Name:      "send",
+	Usage:     "send an existing snapshot to an ssh target, a file or stdout",
+	ArgsUsage: "<dataset[@snapshot]>",
+	Flags: append(append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "stdout",
+			Usage: "write the raw send stream to stdout to pipe into other tools",
+		},
+		cli.StringFlag{
+			Name:  "file",
+			Usage: "write the raw send stream to a new file",
+		},
+		cli.BoolFlag{
+			Name:  "checksum",
+			Usage: "record the sha256 of the stream file in <file>.sha256 for verify-stream",
+		},
+		cli.StringFlag{
+			Name:  "base",
+			Usage: "snapshot to send an incremental from, a full stream is sent without it",
+		},
+		cli.BoolFlag{
+			Name:  "intermediates,I",
+			Usage: "include every snapshot between the base and the snapshot",
+		},
+		recvCmdFlag,
+		checkKeysFlag,
+		compressFlag,
+		compressCmdFlag,
+		decompressCmdFlag,
+		compressThresholdFlag,
+		sizeToleranceFlag,
+		mbufferPortFlag,
+		mbufferAddrFlag,
+		onPartialFlag,
+		setPropFlag,
+	}, remoteFlags...), streamFlags...),
+	Action: func(clix *cli.Context) error {
+		arg := clix.Args().First()
+		if arg == "" {
+			return errors.New("no dataset specified")
+		}
+		var (
+			ctx  = appContext(clix)
+			opts = newSendOpts(clix)
+			name = baseName(arg)
+		)
+		opts.intermediates = clix.Bool("intermediates")
+		if opts.intermediates && clix.String("base") == "" {
+			return errors.New("--intermediates requires --base")
+		}
+		snapshots, err := localhost.snapshots(name, listOpts{depth: 1, sortBy: "creation"})
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("%s has no snapshots", name)
+		}
+		snapshot := snapshots[len(snapshots)-1]
+		if arg != name {
+			if snapshot = findSnapshot(snapshots, name, arg); snapshot == nil {
+				return fmt.Errorf("snapshot %s does not exist", arg)
+			}
+		}
+		var prev *ExtDataset
+		if base := clix.String("base"); base != "" {
+			if prev = findSnapshot(snapshots, name, base); prev == nil {
+				return fmt.Errorf("base snapshot %s does not exist", base)
+			}
+		}
+		if dryRun(clix) {
+			if target := clix.String("send"); target != "" && !clix.Bool("stdout") {
+				fmt.Println(opts.pipeline(newRemote(clix, target), opts.recvArgs(clix.String("dest")), opts.args(snapshot.Name, prev)))
+				return nil
+			}
+			fmt.Println(shellJoin(append([]string{"zfs"}, opts.args(snapshot.Name, prev)...)))
+			return nil
+		}
+		if path := clix.String("file"); path != "" {
+			logrus.WithFields(logrus.Fields{
+				"snapshot": snapshot.Name,
+				"file":     path,
+			}).Info("sending to file")
+			return sendToFile(ctx, opts.args(snapshot.Name, prev), path, clix.Bool("checksum"))
+		}
+		if clix.Bool("stdout") {
+			if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+				return errors.New("refusing to write the send stream to a terminal")
+			}
+			logrus.WithField("snapshot", snapshot.Name).Debug("sending to stdout")
+			return zfsSend(ctx, opts.args(snapshot.Name, prev), os.Stdout)
+		}
+		target := clix.String("send")
+		if target == "" {
+			return errors.New("no ssh target specified, use --send or --stdout")
+		}
+		if clix.String("dest") == "" {
+			return errors.New("no dest specified")
+		}
+		if err := validateRecvCmd(clix.String("recv-cmd")); err != nil {
+			return err
+		}
+		if err := validateTargetUser(clix.String("target-user")); err != nil {
+			return err
+		}
+		if err := validateHostKey(clix.String("target-host-key")); err != nil {
+			return err
+		}
+		if err := validateCompress(clix.String("compress"), clix.String("compress-cmd"), clix.String("decompress-cmd")); err != nil {
+			return err
+		}
+		if err := validateOnPartial(clix.String("on-partial")); err != nil {
+			return err
+		}
+		if err := validateSetProps(clix.StringSlice("set-prop")); err != nil {
+			return err
+		}
+		opts.holdTag = sendHoldTag(runID([]datasetEntry{{Name: name}}))
+		return send(ctx, newRemote(clix, target), clix.String("dest"), opts, &zfs.Dataset{Name: snapshot.Name}, prev)
+	},
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sendHoldPrefix starts the tag of the holds keeping the snapshots being
+// sent from being destroyed, the rest of the tag is the run id
+const sendHoldPrefix = "flux-send-"
+
+// sendHoldTag returns the hold tag of the sends of the run. A run repeated
+// after a crash has the same id and takes over the hold left behind.
+func sendHoldTag(runID string) string {
+	return sendHoldPrefix + runID
+}
+
+// holdSent holds the snapshot until its send is received so that a purge
+// cannot destroy it while a resumable send is still pending, the hold is
+// kept when the snapshot is already held by the same run
+func holdSent(ctx context.Context, tag, snapshot string) error {
+	if tag == "" {
+		return nil
+	}
+	if _, err := zfsOutput(ctx, "hold", tag, snapshot); err != nil {
+		if strings.Contains(err.Error(), "tag already exists") {
+			return nil
+		}
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"snapshot": snapshot,
+		"tag":      tag,
+	}).Debug("held snapshot for send")
+	return nil
+}
+
+// releaseSent releases the hold once the send was received, failing to
+// release leaves a hold reported by validate
+func releaseSent(ctx context.Context, tag, snapshot string) {
+	if tag == "" {
+		return
+	}
+	if _, err := zfsOutput(ctx, "release", tag, snapshot); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"snapshot": snapshot,
+			"tag":      tag,
+		}).Warn("release send hold")
+	}
+}
+
+// releaseStaleSends releases the hold of the tag on the snapshots of the
+// dataset but keep. Sends that failed leave their snapshot held while the
+// next send goes on from another one, the hold would keep purges from
+// destroying it forever.
+func releaseStaleSends(ctx context.Context, tag, dataset, keep string) {
+	if tag == "" {
+		return
+	}
+	holds, err := sendHolds(ctx, dataset)
+	if err != nil {
+		logrus.WithError(err).WithField("dataset", dataset).Warn("list send holds")
+		return
+	}
+	for _, h := range holds {
+		if h.tag == tag && h.snapshot != keep {
+			releaseSent(ctx, tag, h.snapshot)
+		}
+	}
+}
+
+// sendHold is a hold of a snapshot by a send
+type sendHold struct {
+	snapshot string
+	tag      string
+}
+
+// sendHolds returns the send holds on the snapshots of the dataset, holds
+// of sends that crashed or are still running
+func sendHolds(ctx context.Context, name string) ([]sendHold, error) {
+	snapshots, err := localhost.snapshots(name, listOpts{depth: 1, sortBy: "creation"})
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	args := []string{"holds", "-H"}
+	for _, s := range snapshots {
+		args = append(args, s.Name)
+	}
+	out, err := zfsOutput(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	var holds []sendHold
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) >= 2 && strings.HasPrefix(fields[1], sendHoldPrefix) {
+			holds = append(holds, sendHold{
+				snapshot: fields[0],
+				tag:      fields[1],
+			})
+		}
+	}
+	return holds, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReleaseStaleSends(t *testing.T) {
+	orig := localhost
+	localhost = &fakeHost{list: []*ExtDataset{snap("tank/home@a", 1), snap("tank/home@b", 2), snap("tank/home@c", 3)}}
+	defer func() { localhost = orig }()
+	released := filepath.Join(t.TempDir(), "released")
+	t.Setenv("RELEASED", released)
+	// zfs holds -H <snapshots> and zfs release <tag> <snapshot>
+	fakeCommand(t, "zfs", `case "$1" in
+holds)
+	printf 'tank/home@a\tflux-send-daily\tMon Oct 13 00:00 2026\n'
+	printf 'tank/home@a\tzrepl\tMon Oct 13 00:00 2026\n'
+	printf 'tank/home@b\tflux-send-hourly\tTue Oct 14 00:00 2026\n'
+	printf 'tank/home@c\tflux-send-daily\tTue Oct 14 01:00 2026\n'
+	;;
+release)
+	echo "$2 $3" >> "$RELEASED"
+	;;
+esac
+`)
+	for _, tc := range []struct {
+		name string
+		keep string
+		want []string
+	}{
+		{name: "after a send", want: []string{"flux-send-daily tank/home@a", "flux-send-daily tank/home@c"}},
+		{name: "after a resumed send", keep: "tank/home@c", want: []string{"flux-send-daily tank/home@a"}},
+	} {
+		if err := ioutil.WriteFile(released, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		releaseStaleSends(context.Background(), sendHoldTag("daily"), "tank/home", tc.keep)
+		data, err := ioutil.ReadFile(released)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the holds of other runs and tools are kept
+		if got := strings.Split(strings.TrimSpace(string(data)), "\n"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: released %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
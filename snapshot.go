@@ -0,0 +1,1100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var snapshotCommand = cli.Command{
+	Name:      "snapshot",
+	Usage:     "snapshot",
+	ArgsUsage: "[dataset...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "send,s",
+			Usage: "send to an ssh target",
+		},
+		cli.StringFlag{
+			Name:  "dest,d",
+			Usage: "destination",
+		},
+		cli.UintFlag{
+			Name:  "uid",
+			Usage: "ssh user",
+		},
+		cli.UintFlag{
+			Name:  "gid",
+			Usage: "ssh group",
+		},
+		sshBinFlag,
+		remoteZFSFlag,
+		targetUserFlag,
+		targetHostKeyFlag,
+		sshMultiplexFlag,
+		summaryFlag,
+		reportFileFlag,
+		recvCmdFlag,
+		checkKeysFlag,
+		compressFlag,
+		compressCmdFlag,
+		decompressCmdFlag,
+		compressThresholdFlag,
+		sizeToleranceFlag,
+		mbufferPortFlag,
+		mbufferAddrFlag,
+		onPartialFlag,
+		setPropFlag,
+		cli.BoolFlag{
+			Name:  "init",
+			Usage: "send the inital snapshot",
+		},
+		depthFlag,
+		sortByFlag,
+		cli.DurationFlag{
+			Name:  "min-interval",
+			Usage: "skip the snapshot if the newest snapshot is younger than the interval",
+		},
+		cli.BoolFlag{
+			Name:  "auto-purge",
+			Usage: "purge old flux snapshots of the datasets after a successful snapshot",
+		},
+		cli.DurationFlag{
+			Name:  "older-than,o",
+			Usage: "purge snapshots older than when auto purging",
+			Value: 2 * Week,
+		},
+		destroyModeFlag,
+		cli.IntFlag{
+			Name:  "max-snapshots",
+			Usage: "destroy the oldest snapshots before snapshotting so the dataset keeps at most this many",
+		},
+		cli.BoolFlag{
+			Name:  "dry",
+			Usage: "display the snapshots that would be destroyed without snapshotting",
+		},
+		cli.BoolFlag{
+			Name:  "send-props",
+			Usage: "include dataset properties in the send stream",
+		},
+		cli.BoolFlag{
+			Name:  "large-blocks",
+			Usage: "send blocks larger than 128k as-is, requires large_blocks on both pools",
+		},
+		cli.BoolFlag{
+			Name:  "embed",
+			Usage: "send embedded data blocks as-is, requires embedded_data on both pools",
+		},
+		cli.BoolFlag{
+			Name:  "compressed-stream",
+			Usage: "send blocks as compressed on disk, lowers cpu and bandwidth but relies on the dataset compression",
+		},
+		labelFlag,
+		scheduleFlag,
+		datasetFileFlag,
+		profileFlag,
+		cli.BoolFlag{
+			Name:  "no-snapshot",
+			Usage: "send the newest existing snapshot instead of taking a new one, to retry a failed send",
+		},
+		cli.StringFlag{
+			Name:  "snapshot-name",
+			Usage: "name the snapshot (release-1.2.3) instead of a timestamp, purge keeps it unless run with --all",
+		},
+		cli.StringFlag{
+			Name:  "at",
+			Usage: "RFC3339 timestamp to name the snapshot with instead of now, zfs still records the real creation time",
+		},
+		cli.BoolFlag{
+			Name:  "print-cmd",
+			Usage: "print the commands that would be run without running them",
+		},
+		cli.DurationFlag{
+			Name:  "stagger",
+			Usage: "spread the datasets over the window with a fixed offset per dataset to avoid io spikes",
+		},
+		cli.DurationFlag{
+			Name:  "progress",
+			Usage: "log the bytes sent per dataset and in total at the interval, summarizing concurrent sends",
+		},
+		cli.IntFlag{
+			Name:  "concurrency-per-pool",
+			Usage: "snapshot and send datasets concurrently with at most this many per pool, 0 runs them one after another, 1 or 2 suits spinning disks",
+		},
+		cli.BoolFlag{
+			Name:  "recursive,r",
+			Usage: "also snapshot the descendants except those with flux:exclude-recursive=true, combine with --atomic for a consistent instant",
+		},
+		cli.BoolFlag{
+			Name:  "fsfreeze",
+			Usage: "quiesce mounted filesystems with fsfreeze while they are snapshotted, writes pause for the duration of the snapshot",
+		},
+		cli.StringSliceFlag{
+			Name:  "snapshot-property",
+			Usage: "user property=value set on every snapshot taken (backup:class=gold), repeat for more",
+		},
+		cli.BoolFlag{
+			Name:  "mounted-only",
+			Usage: "skip filesystems that are not mounted, volumes are never skipped",
+		},
+		cli.BoolFlag{
+			Name:  "unmounted-only",
+			Usage: "skip filesystems that are mounted, volumes are never skipped",
+		},
+		datasetRegexFlag,
+		cli.BoolFlag{
+			Name:  "include-parents",
+			Usage: "also snapshot the ancestors of the datasets up to the pool with the same snapshot name, without sending them",
+		},
+		cli.BoolFlag{
+			Name:  "atomic",
+			Usage: "snapshot all datasets of a pool at once with a zfs channel program, requires OpenZFS 0.8 or FreeBSD 12",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "snapshot and send even if the pool is faulted or suspended",
+		},
+		forceFullEveryFlag,
+		forceFullIntervalFlag,
+		cli.BoolFlag{
+			Name:  "continue-on-error",
+			Usage: "go on with the next datasets when a send fails after its snapshot was taken and fail at the end of the run",
+		},
+		cli.StringFlag{
+			Name:  "base",
+			Usage: "snapshot to send the incremental from instead of the newest snapshot",
+		},
+		cli.BoolFlag{
+			Name:  "resume-run",
+			Usage: "skip the datasets completed by the previous failed run, requires --state-dir",
+		},
+		cli.StringFlag{
+			Name:  "run-id",
+			Usage: "id of the run to checkpoint, defaults to an id derived from the datasets",
+		},
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "seed a new destination with the snapshots from a snapshot name, RFC3339 time or age (72h) up to the new snapshot",
+		},
+	},
+	Action: func(clix *cli.Context) (err error) {
+		run, err := newSnapshotRun(clix)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := run.summary.write(err); err != nil {
+				logrus.WithError(err).Error("write summary")
+			}
+		}()
+		entries, err := datasetEntries(clix)
+		if err != nil {
+			return err
+		}
+		if clix.Bool("recursive") {
+			if entries, err = expandRecursive(run.ctx, entries); err != nil {
+				return err
+			}
+		}
+		re, err := datasetRegex(clix)
+		if err != nil {
+			return err
+		}
+		entries = matchEntries(entries, re)
+		if clix.Bool("include-parents") {
+			entries = includeParents(entries)
+		}
+		for _, e := range entries {
+			if e.Target != "" && run.limit == 1 && !run.initS {
+				return errors.New("max-snapshots must be at least 2 to keep the incremental base")
+			}
+		}
+		if !run.dry && !run.printCmd {
+			id := clix.String("run-id")
+			if id == "" {
+				id = runID(entries)
+			}
+			if run.checkpoint, err = newCheckpoint(run.opts.state, id, clix.Bool("resume-run")); err != nil {
+				return err
+			}
+			run.opts.holdTag = sendHoldTag(id)
+		}
+		if interval := clix.Duration("progress"); interval > 0 && !run.dry && !run.printCmd {
+			run.opts.progress = newProgress()
+			ctx, cancel := context.WithCancel(run.ctx)
+			defer cancel()
+			go run.opts.progress.report(ctx, interval)
+			defer run.opts.progress.log()
+		}
+		defer run.mux.close()
+		if err := run.datasets(entries); err != nil {
+			return err
+		}
+		return run.checkpoint.clear()
+	},
+}
+
+// datasets snapshots all the datasets of the run
+func (run *snapshotRun) datasets(entries []datasetEntry) error {
+	if run.clix.Bool("atomic") {
+		return run.atomic(entries)
+	}
+	stagger := run.clix.Duration("stagger")
+	if run.dry || run.printCmd {
+		stagger = 0
+	}
+	if stagger > 0 {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return staggerOffset(entries[i].Name, stagger) < staggerOffset(entries[j].Name, stagger)
+		})
+	}
+	if perPool := run.clix.Int("concurrency-per-pool"); perPool > 0 && !run.dry && !run.printCmd {
+		return run.concurrent(entries, perPool, stagger)
+	}
+	for i, e := range entries {
+		if err := run.ctx.Err(); err != nil {
+			run.logSkipped(entries[i:])
+			return err
+		}
+		if stagger > 0 {
+			if err := waitUntil(run.ctx, run.now.Add(staggerOffset(e.Name, stagger))); err != nil {
+				run.logSkipped(entries[i:])
+				return err
+			}
+		}
+		if err := run.dataset(e); err != nil && !run.continued(e, err) {
+			return err
+		}
+	}
+	return run.sendFailures()
+}
+
+// continued records the failed send of the dataset and returns true when
+// the run continues after it
+func (run *snapshotRun) continued(e datasetEntry, err error) bool {
+	var serr sendError
+	if !run.continueOnError || !errors.As(err, &serr) {
+		return false
+	}
+	logrus.WithError(err).WithField("dataset", e.Name).Error("send failed, continuing with the next datasets")
+	run.mu.Lock()
+	run.failedSends = append(run.failedSends, e.key())
+	run.mu.Unlock()
+	return true
+}
+
+// sendFailures returns the error of the sends that failed in a run that
+// continued after them
+func (run *snapshotRun) sendFailures() error {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if len(run.failedSends) == 0 {
+		return nil
+	}
+	return sendFailures(run.failedSends)
+}
+
+// logSkipped reports the datasets left out when a run is aborted
+func (run *snapshotRun) logSkipped(entries []datasetEntry) {
+	run.summary.skip(entries)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.key())
+	}
+	if len(names) > 0 {
+		logrus.WithField("datasets", strings.Join(names, ",")).Warn("run aborted, datasets skipped")
+	}
+}
+
+// snapshotRun holds the settings shared by every dataset of a snapshot run
+type snapshotRun struct {
+	clix        *cli.Context
+	ctx         context.Context
+	now         time.Time
+	stamp       time.Time
+	initS       bool
+	purge       bool
+	limit       int
+	dry         bool
+	printCmd    bool
+	minInterval time.Duration
+	list        listOpts
+	mode        zfs.DestroyFlag
+	opts        sendOpts
+	cache       *snapshotCache
+	mu          sync.Mutex
+	// pools are the pools checked for health in the run
+	pools      map[string]bool
+	force      bool
+	since      string
+	base       string
+	checkpoint *checkpoint
+	// snapshotName replaces the timestamped snapshot name when set
+	snapshotName string
+	// noSnapshot sends the newest existing snapshot without taking one
+	noSnapshot bool
+	// mux shares the ssh connections of the run
+	mux *sshMux
+	// summary records the outcome of every dataset for --summary-json
+	// and --report-file
+	summary *runSummary
+	// fsfreeze freezes mounted filesystems while they are snapshotted
+	fsfreeze bool
+	// props are the user properties set on every snapshot taken
+	props []string
+	// mounted is yes to only snapshot mounted filesystems and no for
+	// unmounted ones
+	mounted string
+	// continueOnError goes on with the next datasets after a failed send,
+	// failedSends are the datasets whose send failed
+	continueOnError bool
+	failedSends     []string
+	// full schedules the full sends replacing the destinations
+	full fullPolicy
+}
+
+func newSnapshotRun(clix *cli.Context) (*snapshotRun, error) {
+	run := &snapshotRun{
+		clix:         clix,
+		ctx:          appContext(clix),
+		now:          time.Now(),
+		initS:        clix.Bool("init"),
+		purge:        clix.Bool("auto-purge"),
+		limit:        clix.Int("max-snapshots"),
+		dry:          dryRun(clix),
+		printCmd:     clix.Bool("print-cmd") || clix.GlobalBool("dry-run"),
+		minInterval:  clix.Duration("min-interval"),
+		opts:         newSendOpts(clix),
+		cache:        newSnapshotCache(),
+		pools:        make(map[string]bool),
+		force:        clix.Bool("force"),
+		since:        clix.String("since"),
+		base:         clix.String("base"),
+		snapshotName: clix.String("snapshot-name"),
+		noSnapshot:   clix.Bool("no-snapshot"),
+		summary:      newRunSummary(clix.String("summary-json"), clix.String("report-file")),
+		props:        clix.StringSlice("snapshot-property"),
+		fsfreeze:     clix.Bool("fsfreeze"),
+	}
+	run.continueOnError = clix.Bool("continue-on-error")
+	switch {
+	case clix.Bool("mounted-only") && clix.Bool("unmounted-only"):
+		return nil, errors.New("--mounted-only cannot be used with --unmounted-only")
+	case clix.Bool("mounted-only"):
+		run.mounted = "yes"
+	case clix.Bool("unmounted-only"):
+		run.mounted = "no"
+	}
+	if run.noSnapshot && (clix.Bool("atomic") || run.snapshotName != "") {
+		return nil, errors.New("--no-snapshot cannot be used with --atomic or --snapshot-name")
+	}
+	if run.snapshotName != "" {
+		if err := validateSnapshotName(run.snapshotName); err != nil {
+			return nil, err
+		}
+	}
+	if run.base != "" && run.initS {
+		return nil, errors.New("--base cannot be used with --init")
+	}
+	if err := validateRecvCmd(clix.String("recv-cmd")); err != nil {
+		return nil, err
+	}
+	if err := validateTargetUser(clix.String("target-user")); err != nil {
+		return nil, err
+	}
+	if err := validateHostKey(clix.String("target-host-key")); err != nil {
+		return nil, err
+	}
+	if err := validateCompress(clix.String("compress"), clix.String("compress-cmd"), clix.String("decompress-cmd")); err != nil {
+		return nil, err
+	}
+	if err := validateOnPartial(clix.String("on-partial")); err != nil {
+		return nil, err
+	}
+	if err := validateSetProps(clix.StringSlice("set-prop")); err != nil {
+		return nil, err
+	}
+	for _, p := range run.props {
+		if err := validateUserProp(p); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if run.list, err = newListOpts(clix); err != nil {
+		return nil, err
+	}
+	if run.mux, err = newSSHMux(clix); err != nil {
+		return nil, err
+	}
+	if run.mode, err = parseDestroyMode(clix.String("destroy-mode")); err != nil {
+		return nil, err
+	}
+	if run.full, err = newFullPolicy(clix, run.opts.state); err != nil {
+		return nil, err
+	}
+	run.stamp = run.now
+	if at := clix.String("at"); at != "" {
+		if run.stamp, err = time.Parse(time.RFC3339, at); err != nil {
+			return nil, fmt.Errorf("invalid --at timestamp: %w", err)
+		}
+		if run.stamp.After(run.now) {
+			logrus.WithField("at", at).Warn("snapshot timestamp is in the future")
+		}
+	}
+	return run, nil
+}
+
+// snapshotJob is a dataset being snapshotted in a run
+type snapshotJob struct {
+	entry    datasetEntry
+	set      *zfs.Dataset
+	prev     *ExtDataset
+	name     string
+	remote   *remote
+	policy   purgePolicy
+	snapshot *zfs.Dataset
+	// since is the first snapshot sent to seed the destination
+	since *ExtDataset
+	// existing is the snapshot sent instead of taking a new one
+	existing *ExtDataset
+	// sent is true once the snapshot was sent
+	sent bool
+	// bytes counts the bytes sent for the job
+	bytes *byteCounter
+	// started is when the job was prepared
+	started time.Time
+	// destroyed are the snapshots purged by the job
+	destroyed []string
+	// baseFrom is how prev was chosen, shown by dry runs
+	baseFrom string
+	// full replaces the destination with a scheduled full send
+	full bool
+	// stage is the step the job is at: snapshot, property, send, purge
+	// or checkpoint, a failure is reported with it
+	stage string
+}
+
+// purged records a snapshot destroyed by the purges of the job
+func (job *snapshotJob) purged(s *ExtDataset) {
+	job.destroyed = append(job.destroyed, s.Name)
+}
+
+// permissions returns the zfs allow permissions the run needs on the dataset
+func (run *snapshotRun) permissions(e datasetEntry) []string {
+	perms := []string{"snapshot", "mount"}
+	if e.Target != "" {
+		perms = append(perms, "send", "hold", "release")
+	}
+	if run.purge || run.limit > 0 {
+		perms = append(perms, "destroy")
+	}
+	// the label, the creation time of named snapshots, the snapshot
+	// properties and the last sent mark are user properties
+	if e.Label != "" || run.snapshotName != "" || len(run.props) > 0 || e.Target != "" {
+		perms = append(perms, "userprop")
+	}
+	return perms
+}
+
+// dataset snapshots, sends and purges a single dataset
+func (run *snapshotRun) dataset(e datasetEntry) error {
+	job, err := run.prepare(e)
+	if err == nil && job != nil {
+		if err = run.take(job); err == nil {
+			err = run.finish(job)
+		}
+	}
+	run.summary.add(e, job, err)
+	if err != nil && job != nil && job.stage == "send" {
+		err = sendError{err}
+	}
+	return err
+}
+
+// concurrent runs the datasets concurrently, at most perPool at a time on
+// the same pool so that the datasets of a pool do not contend for its
+// disks while other pools proceed. No new dataset is started after one
+// fails, the running ones are left to complete.
+func (run *snapshotRun) concurrent(entries []datasetEntry, perPool int, stagger time.Duration) error {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		failed  error
+		skipped []datasetEntry
+		sems    = make(map[string]chan struct{})
+	)
+	skip := func(e datasetEntry) {
+		mu.Lock()
+		skipped = append(skipped, e)
+		mu.Unlock()
+	}
+	fail := func(err error) {
+		mu.Lock()
+		if failed == nil {
+			failed = err
+		}
+		mu.Unlock()
+	}
+	hasFailed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed != nil
+	}
+	for _, e := range entries {
+		pool := poolName(e.Name)
+		sem, ok := sems[pool]
+		if !ok {
+			sem = make(chan struct{}, perPool)
+			sems[pool] = sem
+		}
+		wg.Add(1)
+		go func(e datasetEntry, sem chan struct{}) {
+			defer wg.Done()
+			if stagger > 0 {
+				if err := waitUntil(run.ctx, run.now.Add(staggerOffset(e.Name, stagger))); err != nil {
+					skip(e)
+					fail(err)
+					return
+				}
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-run.ctx.Done():
+				skip(e)
+				fail(run.ctx.Err())
+				return
+			}
+			defer func() { <-sem }()
+			if hasFailed() {
+				skip(e)
+				return
+			}
+			if err := run.dataset(e); err != nil && !run.continued(e, err) {
+				logrus.WithError(err).WithField("dataset", e.Name).Error("snapshot dataset")
+				fail(err)
+			}
+		}(e, sem)
+	}
+	wg.Wait()
+	if run.ctx.Err() != nil {
+		run.logSkipped(skipped)
+	} else {
+		run.summary.skip(skipped)
+	}
+	if failed != nil {
+		return failed
+	}
+	return run.sendFailures()
+}
+
+// checkPool checks the health of the pool once per run
+func (run *snapshotRun) checkPool(pool string) error {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.pools[pool] {
+		return nil
+	}
+	if err := checkPool(run.ctx, pool); err != nil {
+		return err
+	}
+	run.pools[pool] = true
+	return nil
+}
+
+// prepare returns the job to snapshot the dataset or nil if it is skipped
+func (run *snapshotRun) prepare(e datasetEntry) (*snapshotJob, error) {
+	job := &snapshotJob{
+		entry:   e,
+		policy:  e.policy(),
+		name:    snapshotName(e.Label, run.stamp),
+		bytes:   &byteCounter{n: new(int64)},
+		started: time.Now(),
+		stage:   "snapshot",
+	}
+	job.policy.destroyed = job.purged
+	if run.snapshotName != "" {
+		job.name = run.snapshotName
+	}
+	if err := validateFullName(e.Name, job.name); err != nil {
+		return nil, err
+	}
+	if run.checkpoint.isDone(e.key()) {
+		logrus.WithField("dataset", e.Name).Info("skipping dataset completed by the previous run")
+		return nil, nil
+	}
+	job.policy.destroyMode = run.mode
+	if !run.force {
+		if err := run.checkPool(poolName(e.Name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkPermissions(run.ctx, e.Name, run.permissions(e)); err != nil {
+		return nil, err
+	}
+	if e.Target != "" {
+		job.remote = run.mux.add(newRemote(run.clix, e.Target))
+	}
+	set, err := zfs.GetDataset(e.Name)
+	if err != nil {
+		return nil, err
+	}
+	job.set = set
+	if run.mounted != "" {
+		skip, err := skipMount(set, run.mounted)
+		if err != nil || skip {
+			return nil, err
+		}
+	}
+	snapshots, err := run.cache.get(run.ctx, set, run.list)
+	if err != nil {
+		return nil, err
+	}
+	if e.Parent {
+		if run.noSnapshot {
+			return nil, nil
+		}
+		for _, s := range snapshots {
+			if s.Name == set.Name+"@"+job.name {
+				logrus.WithField("snapshot", s.Name).Info("skipping parent, snapshot exists")
+				return nil, nil
+			}
+		}
+	}
+	if run.noSnapshot {
+		return run.existing(job, snapshots)
+	}
+	// the listing of a recursive entry holds the snapshots of its children
+	own := ownSnapshots(snapshots, set.Name)
+	if len(own) > 0 {
+		job.prev = own[len(own)-1]
+		job.baseFrom = "newest local snapshot"
+	}
+	interval := run.minInterval
+	if e.MinInterval > 0 {
+		interval = e.MinInterval
+	}
+	if interval > 0 {
+		if newest := newestLabeled(own, e.Label); newest != nil && run.now.Sub(newest.Created) < interval {
+			logrus.WithFields(logrus.Fields{
+				"dataset": e.Name,
+				"age":     run.now.Sub(newest.Created),
+			}).Info("skipping snapshot, newest snapshot is within min interval")
+			return nil, nil
+		}
+	}
+	if run.base != "" {
+		if job.prev, err = baseSnapshot(snapshots, set.Name, run.base); err != nil {
+			return nil, err
+		}
+		job.baseFrom = "--base"
+	}
+	if run.initS {
+		job.prev = nil
+		job.baseFrom = "--init"
+	}
+	if job.remote != nil && job.prev != nil && run.base == "" && run.since == "" {
+		job.prev = run.commonBase(job, snapshots)
+		due, err := run.full.due(e.Name, job.remote.target, run.now)
+		if err != nil {
+			return nil, err
+		}
+		if due {
+			children, err := destChildren(remoteHost{ctx: run.ctx, remote: job.remote}, e.Dest)
+			if err != nil {
+				return nil, err
+			}
+			if len(children) > 0 {
+				logrus.WithFields(logrus.Fields{
+					"dest":     e.Dest,
+					"children": strings.Join(children, ","),
+				}).Warn("skipping the scheduled full send, replacing the destination would destroy its child datasets")
+			} else {
+				job.prev, job.full = nil, true
+				job.baseFrom = "scheduled full send replacing the destination"
+			}
+		}
+	}
+	if run.since != "" && job.remote != nil {
+		if job.since, err = sinceSnapshot(snapshots, set.Name, run.since, run.now); err != nil {
+			return nil, err
+		}
+	}
+	if job.remote != nil && (run.dry || run.printCmd) {
+		fmt.Printf("%s: %s\n", set.Name, job.sendPlan())
+	}
+	if run.limit > 0 {
+		// keep room for the snapshot about to be taken
+		capped := purgePolicy{
+			retention:   map[string]int{e.Label: run.limit - 1},
+			destroyMode: run.mode,
+			destroyed:   job.purged,
+		}
+		decisions := capped.checkClones(capped.decide(run.now, own))
+		switch {
+		case run.printCmd:
+			for _, d := range decisions {
+				if d.destroy {
+					fmt.Println(shellJoin(append(append([]string{"zfs", "destroy"}, destroyArgs(run.mode)...), d.snapshot.Name)))
+				}
+			}
+		case run.dry:
+			return nil, newPurgeReport(decisions).renderText(os.Stdout)
+		default:
+			if err := destroySnapshots(run.ctx, localhost, capped, decisions, false); err != nil {
+				return nil, err
+			}
+			run.cache.invalidate(set.Name)
+		}
+	}
+	if run.dry && !run.printCmd {
+		return nil, nil
+	}
+	if run.printCmd {
+		fmt.Println(shellJoin([]string{"zfs", "snapshot", set.Name + "@" + job.name}))
+		switch {
+		case job.remote != nil && job.since != nil:
+			opts := run.opts
+			opts.intermediates = true
+			fmt.Println(run.opts.pipeline(job.remote, run.opts.recvArgs(e.Dest), run.opts.args(job.since.Name, nil)))
+			fmt.Println(opts.pipeline(job.remote, opts.recvArgs(e.Dest), opts.args(set.Name+"@"+job.name, job.since)))
+		case job.remote != nil:
+			fmt.Println(run.opts.pipeline(job.remote, run.opts.recvArgs(e.Dest), run.opts.args(set.Name+"@"+job.name, job.prev)))
+		}
+		return nil, nil
+	}
+	return job, nil
+}
+
+// existing prepares the job to send the newest existing snapshot of the
+// dataset from the snapshot before it
+func (run *snapshotRun) existing(job *snapshotJob, snapshots []*ExtDataset) (*snapshotJob, error) {
+	var own []*ExtDataset
+	for _, s := range snapshots {
+		if s.BaseName == job.set.Name && s.Label == job.entry.Label {
+			own = append(own, s)
+		}
+	}
+	if len(own) == 0 {
+		return nil, fmt.Errorf("%s has no snapshot to send", job.set.Name)
+	}
+	newest := own[len(own)-1]
+	job.name = shortName(newest.Name)
+	job.existing = newest
+	job.prev = nil
+	if len(own) > 1 {
+		job.prev = own[len(own)-2]
+	}
+	if run.base != "" {
+		var err error
+		if job.prev, err = baseSnapshot(snapshots, job.set.Name, run.base); err != nil {
+			return nil, err
+		}
+	}
+	if run.initS {
+		job.prev = nil
+	}
+	if run.dry {
+		return nil, nil
+	}
+	if run.printCmd {
+		if job.remote != nil {
+			fmt.Println(run.opts.pipeline(job.remote, run.opts.recvArgs(job.entry.Dest), run.opts.args(newest.Name, job.prev)))
+		}
+		return nil, nil
+	}
+	return job, nil
+}
+
+// take creates the snapshot for the job
+func (run *snapshotRun) take(job *snapshotJob) error {
+	if job.existing != nil {
+		job.snapshot = job.existing.Dataset
+		return nil
+	}
+	if run.fsfreeze {
+		unfreeze, err := freeze(run.ctx, job.set)
+		if err != nil {
+			return err
+		}
+		defer unfreeze()
+	}
+	snapshot, err := run.snapshot(job)
+	if err != nil {
+		return err
+	}
+	return run.taken(job, snapshot)
+}
+
+// snapshotAttempts bounds the names tried when snapshots of the dataset are
+// taken concurrently within the same second
+const snapshotAttempts = 5
+
+// snapshot creates the snapshot of the job. When a timestamped name is
+// already taken by a concurrent run the snapshot is retried with
+// nanoseconds added to its time, an explicit --snapshot-name is never
+// changed.
+func (run *snapshotRun) snapshot(job *snapshotJob) (*zfs.Dataset, error) {
+	for attempt := 1; ; attempt++ {
+		snapshot, err := job.set.Snapshot(job.name, false)
+		if err == nil || run.snapshotName != "" || !alreadyExists(err) {
+			return snapshot, err
+		}
+		if attempt == snapshotAttempts {
+			return nil, fmt.Errorf("unable to find a unique snapshot name for %s after %d attempts: %w", job.set.Name, attempt, err)
+		}
+		// the name keeps the time of the run or of --at, the nanoseconds of
+		// the clock tell it apart from the other snapshots of that second
+		ns := time.Now().Nanosecond()
+		if ns == 0 {
+			ns = attempt
+		}
+		name := preciseSnapshotName(job.entry.Label, run.stamp.Truncate(time.Second).Add(time.Duration(ns)))
+		logrus.WithFields(logrus.Fields{
+			"dataset": job.set.Name,
+			"name":    job.name,
+			"retry":   name,
+		}).Warn("snapshot name already exists")
+		job.name = name
+	}
+}
+
+// skipMount returns true when the mounted property of the filesystem is not
+// the wanted one, volumes have no mounted property and are never skipped
+func skipMount(set *zfs.Dataset, want string) (bool, error) {
+	if set.Type == zfs.DatasetVolume {
+		return false, nil
+	}
+	mounted, err := set.GetProperty("mounted")
+	if err != nil {
+		return false, err
+	}
+	if mounted == want {
+		return false, nil
+	}
+	logrus.WithFields(logrus.Fields{
+		"dataset": set.Name,
+		"mounted": mounted,
+	}).Info("skipping dataset, mount state does not match")
+	return true, nil
+}
+
+// alreadyExists returns true when zfs failed because the dataset exists
+func alreadyExists(err error) bool {
+	var zerr *zfs.Error
+	return errors.As(err, &zerr) && strings.Contains(zerr.Stderr, "already exists")
+}
+
+// taken records the snapshot created for the job
+func (run *snapshotRun) taken(job *snapshotJob, snapshot *zfs.Dataset) error {
+	job.snapshot = snapshot
+	job.stage = "property"
+	run.cache.invalidate(job.set.Name)
+	if job.entry.Label != "" {
+		if err := snapshot.SetProperty(labelProp, job.entry.Label); err != nil {
+			return err
+		}
+	}
+	if run.snapshotName != "" {
+		if err := snapshot.SetProperty(createdProp, run.stamp.Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+	for _, p := range run.props {
+		kv := strings.SplitN(p, "=", 2)
+		if err := snapshot.SetProperty(kv[0], kv[1]); err != nil {
+			return fmt.Errorf("set %s on %s: %w", kv[0], snapshot.Name, err)
+		}
+	}
+	return nil
+}
+
+// finish sends and purges after the snapshot of the job was taken
+func (run *snapshotRun) finish(job *snapshotJob) error {
+	opts := run.opts
+	opts.sent = job.bytes
+	job.stage = "send"
+	if job.remote != nil && job.since != nil {
+		if err := send(run.ctx, job.remote, job.entry.Dest, opts, job.since.Dataset, nil); err != nil {
+			return job.sendFailed(err)
+		}
+		opts.intermediates = true
+		if err := send(run.ctx, job.remote, job.entry.Dest, opts, job.snapshot, job.since); err != nil {
+			return job.sendFailed(err)
+		}
+		job.sent = true
+	} else if job.full {
+		if err := replaceDest(run.ctx, job.remote, job.entry.Dest, opts, job.snapshot); err != nil {
+			return job.sendFailed(err)
+		}
+		job.sent = true
+	} else if job.remote != nil {
+		if err := send(run.ctx, job.remote, job.entry.Dest, opts, job.snapshot, job.prev); err != nil {
+			return job.sendFailed(err)
+		}
+		job.sent = true
+	}
+	if job.sent && job.since == nil {
+		if err := run.full.record(job.entry.Name, job.remote.target, job.full || job.prev == nil, run.now); err != nil {
+			logrus.WithError(err).WithField("dataset", job.entry.Name).Warn("record send for --force-full-every")
+		}
+	}
+	if run.purge {
+		job.stage = "purge"
+		snapshots, err := run.cache.get(run.ctx, job.set, run.list)
+		if err != nil {
+			return err
+		}
+		// the descendants in a recursive listing are purged by their own jobs
+		own := ownSnapshots(snapshots, job.set.Name)
+		policy := job.policy
+		err = destroySnapshots(run.ctx, localhost, policy, policy.checkClones(policy.decide(run.now, own)), false)
+		run.cache.invalidate(job.set.Name)
+		if err != nil {
+			return err
+		}
+	}
+	job.stage = "checkpoint"
+	return run.checkpoint.markDone(job.entry.key())
+}
+
+// sendFailed records the stage of a failed send, the destination
+// properties are set once the stream was received
+func (job *snapshotJob) sendFailed(err error) error {
+	var perr destPropsError
+	if errors.As(err, &perr) {
+		job.stage = "property"
+	}
+	return err
+}
+
+// sendPlan describes the send of the job and how its base was chosen
+func (job *snapshotJob) sendPlan() string {
+	to := fmt.Sprintf("to %s:%s", job.remote.target, job.entry.Dest)
+	switch {
+	case job.since != nil:
+		return fmt.Sprintf("full send of %s then the snapshots up to the new one %s (--since)", job.since.Name, to)
+	case job.prev != nil:
+		return fmt.Sprintf("incremental send from %s (%s) %s", job.prev.Name, job.baseFrom, to)
+	case job.baseFrom != "":
+		return fmt.Sprintf("full send %s (%s)", to, job.baseFrom)
+	}
+	return fmt.Sprintf("full send %s (no earlier snapshot)", to)
+}
+
+// commonBase returns the newest snapshot of the dataset that exists on the
+// destination so that a destination left behind by a failed send is sent
+// from the snapshot it actually has. Snapshots are matched by guid. The
+// newest snapshot is returned when the destination cannot be listed.
+func (run *snapshotRun) commonBase(job *snapshotJob, snapshots []*ExtDataset) *ExtDataset {
+	return job.commonBase(remoteHost{ctx: run.ctx, remote: job.remote}, snapshots)
+}
+
+// commonBase returns the newest snapshot of the job on the destination
+// host, see snapshotRun.commonBase
+func (job *snapshotJob) commonBase(h host, snapshots []*ExtDataset) *ExtDataset {
+	remoteSnapshots, err := h.snapshots(job.entry.Dest, listOpts{depth: 1, sortBy: "creation"})
+	if err != nil {
+		logrus.WithError(err).WithField("dest", job.entry.Dest).Warn("list destination snapshots, sending from the newest snapshot")
+		return job.prev
+	}
+	onDest := make(map[string]bool)
+	for _, s := range remoteSnapshots {
+		onDest[snapshotID(s)] = true
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		if s.BaseName != job.set.Name || !onDest[snapshotID(s)] {
+			continue
+		}
+		if s != job.prev {
+			logrus.WithFields(logrus.Fields{
+				"dest":     job.entry.Dest,
+				"snapshot": s.Name,
+			}).Warn("destination is behind the source, sending from its newest snapshot")
+		}
+		job.baseFrom = "newest snapshot on the destination"
+		return s
+	}
+	logrus.WithField("dest", job.entry.Dest).Warn("no common snapshot with the destination, sending from the newest snapshot")
+	return job.prev
+}
+
+// baseSnapshot returns the snapshot of the dataset named by --base
+func baseSnapshot(snapshots []*ExtDataset, name, base string) (*ExtDataset, error) {
+	s := findSnapshot(snapshots, name, base)
+	if s == nil {
+		return nil, fmt.Errorf("base snapshot %s does not exist", base)
+	}
+	return s, nil
+}
+
+// sinceSnapshot returns the snapshot of the dataset the since point refers to.
+// The point is a snapshot name, an RFC3339 time or an age, for times the
+// oldest snapshot created at or after it is returned.
+func sinceSnapshot(snapshots []*ExtDataset, name, since string, now time.Time) (*ExtDataset, error) {
+	own := ownSnapshots(snapshots, name)
+	mark, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		age, derr := time.ParseDuration(since)
+		if derr != nil {
+			if s := findSnapshot(own, name, since); s != nil {
+				return s, nil
+			}
+			return nil, fmt.Errorf("since snapshot %s does not exist", since)
+		}
+		mark = now.Add(-age)
+	}
+	for _, s := range own {
+		if !s.Created.Before(mark) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no snapshot of %s since %s", name, mark.Format(time.RFC3339))
+}
+
+// findSnapshot returns the snapshot of the dataset given by its full name
+// or the part after the @
+func findSnapshot(snapshots []*ExtDataset, name, snap string) *ExtDataset {
+	full := name + "@" + strings.TrimPrefix(snap, "@")
+	for _, s := range snapshots {
+		if s.BaseName == name && (s.Name == full || s.Name == snap) {
+			return s
+		}
+	}
+	return nil
+}
+
+// staggerOffset returns the offset of the dataset within the stagger window.
+// The offset is derived from the name so a dataset keeps the same slot
+// across runs.
+func staggerOffset(name string, window time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return time.Duration(h.Sum64() % uint64(window))
+}
+
+// waitUntil blocks until t or ctx is canceled
+func waitUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
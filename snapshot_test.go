@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/urfave/cli"
+)
+
+func TestCommonBase(t *testing.T) {
+	var (
+		a     = snap("tank/home@a", 1)
+		b     = snap("tank/home@b", 2)
+		c     = snap("tank/home@c", 3)
+		child = snap("tank/home/db@d", 4)
+		local = []*ExtDataset{a, b, child, c}
+	)
+	for _, tc := range []struct {
+		name     string
+		dest     *fakeHost
+		want     *ExtDataset
+		baseFrom string
+	}{
+		{
+			name:     "up to date",
+			dest:     &fakeHost{list: []*ExtDataset{snap("backup/home@a", 1), snap("backup/home@b", 2), snap("backup/home@c", 3)}},
+			want:     c,
+			baseFrom: "newest snapshot on the destination",
+		},
+		{
+			name:     "lagging destination",
+			dest:     &fakeHost{list: []*ExtDataset{snap("backup/home@a", 1), snap("backup/home@b", 2)}},
+			want:     b,
+			baseFrom: "newest snapshot on the destination",
+		},
+		{
+			name:     "renamed on the destination",
+			dest:     &fakeHost{list: []*ExtDataset{snap("backup/home@old-a", 1)}},
+			want:     a,
+			baseFrom: "newest snapshot on the destination",
+		},
+		{
+			name:     "no common snapshot",
+			dest:     &fakeHost{list: []*ExtDataset{snap("backup/home@x", 9)}},
+			want:     c,
+			baseFrom: "newest local snapshot",
+		},
+		{
+			name:     "only a child in common",
+			dest:     &fakeHost{list: []*ExtDataset{snap("backup/home@d", 4)}},
+			want:     c,
+			baseFrom: "newest local snapshot",
+		},
+		{
+			name:     "listing error",
+			dest:     &fakeHost{listErr: errors.New("ssh: connect to host backup: connection refused")},
+			want:     c,
+			baseFrom: "newest local snapshot",
+		},
+	} {
+		job := &snapshotJob{
+			entry:    datasetEntry{Name: "tank/home", Dest: "backup/home"},
+			set:      &zfs.Dataset{Name: "tank/home"},
+			prev:     c,
+			baseFrom: "newest local snapshot",
+		}
+		got := job.commonBase(tc.dest, local)
+		if got != tc.want {
+			t.Errorf("%s: base %v, want %s", tc.name, got, tc.want.Name)
+		}
+		if job.baseFrom != tc.baseFrom {
+			t.Errorf("%s: base from %q, want %q", tc.name, job.baseFrom, tc.baseFrom)
+		}
+	}
+}
+
+func TestCommonBaseWithoutGUID(t *testing.T) {
+	// snapshots are matched by name when the guid is not known
+	var (
+		a   = snap("tank/home@a", 0)
+		b   = snap("tank/home@b", 0)
+		job = &snapshotJob{
+			entry: datasetEntry{Name: "tank/home", Dest: "backup/home"},
+			set:   &zfs.Dataset{Name: "tank/home"},
+			prev:  b,
+		}
+	)
+	if got := job.commonBase(&fakeHost{list: []*ExtDataset{snap("backup/home@a", 0)}}, []*ExtDataset{a, b}); got != a {
+		t.Errorf("base %v, want %s", got, a.Name)
+	}
+}
+
+func TestBaseSnapshot(t *testing.T) {
+	snapshot := func(name string) *ExtDataset {
+		return &ExtDataset{
+			Dataset:  &zfs.Dataset{Name: name},
+			BaseName: strings.SplitN(name, "@", 2)[0],
+		}
+	}
+	var (
+		home      = snapshot("tank/home@monday")
+		db        = snapshot("tank/home/db@tuesday")
+		snapshots = []*ExtDataset{home, snapshot("tank/home@tuesday"), db}
+	)
+	for _, tc := range []struct {
+		name string
+		set  string
+		base string
+		want *ExtDataset
+		err  bool
+	}{
+		{name: "short name", set: "tank/home", base: "monday", want: home},
+		{name: "short name with @", set: "tank/home", base: "@monday", want: home},
+		{name: "full name", set: "tank/home", base: "tank/home@monday", want: home},
+		{name: "child dataset", set: "tank/home/db", base: "tuesday", want: db},
+		{name: "missing", set: "tank/home", base: "friday", err: true},
+		{name: "other dataset", set: "tank/home", base: "tank/home/db@tuesday", err: true},
+	} {
+		got, err := baseSnapshot(snapshots, tc.set, tc.base)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: base %v, want %v", tc.name, got, tc.want)
+		}
+		if s := findSnapshot(snapshots, tc.set, tc.base); s != tc.want {
+			t.Errorf("%s: found %v, want %v", tc.name, s, tc.want)
+		}
+	}
+}
+
+func TestBaseWithInit(t *testing.T) {
+	clix := flagContext(t, snapshotCommand.Flags, "--base", "monday", "--init")
+	clix.App = cli.NewApp()
+	clix.App.Metadata = map[string]interface{}{"context": context.Background()}
+	_, err := newSnapshotRun(clix)
+	if err == nil || !strings.Contains(err.Error(), "--base cannot be used with --init") {
+		t.Fatalf("error %v, want --base cannot be used with --init", err)
+	}
+}
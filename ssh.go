@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// muxCloseTimeout bounds closing a master connection when the run ends
+const muxCloseTimeout = 10 * time.Second
+
+var sshMultiplexFlag = cli.BoolFlag{
+	Name:  "ssh-multiplex",
+	Usage: "reuse one ssh connection per target for the whole run instead of connecting for every command, much faster over many datasets",
+}
+
+// sshMux shares an ssh master connection per target between the commands
+// of a run with ssh ControlMaster. The first command to a target opens the
+// master, later ones reuse it and close tears the masters down.
+// A nil sshMux does not multiplex.
+type sshMux struct {
+	dir     string
+	mu      sync.Mutex
+	remotes map[string]*remote
+}
+
+// newSSHMux returns the multiplexer of the run, nil when --ssh-multiplex is not set
+func newSSHMux(clix *cli.Context) (*sshMux, error) {
+	if !clix.Bool("ssh-multiplex") {
+		return nil, nil
+	}
+	dir, err := ioutil.TempDir("", "flux-ssh-")
+	if err != nil {
+		return nil, err
+	}
+	return &sshMux{
+		dir:     dir,
+		remotes: make(map[string]*remote),
+	}, nil
+}
+
+// add makes the remote use the master connection of its target
+func (m *sshMux) add(r *remote) *remote {
+	if m == nil {
+		return r
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.remotes) == 0 && os.Geteuid() == 0 {
+		// ssh runs as the ssh user and has to create the control socket
+		if err := os.Chown(m.dir, int(r.uid), int(r.gid)); err != nil {
+			logrus.WithError(err).Warn("chown ssh control directory")
+		}
+	}
+	// %C hashes the connection keeping the socket path short
+	r.controlPath = filepath.Join(m.dir, "%C")
+	if _, ok := m.remotes[r.target]; !ok {
+		m.remotes[r.target] = r
+	}
+	return r
+}
+
+// close exits the master connections and removes their sockets
+func (m *sshMux) close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for target, r := range m.remotes {
+		ctx, cancel := context.WithTimeout(context.Background(), muxCloseTimeout)
+		if err := r.ssh(ctx, "-O", "exit", target).Run(); err != nil {
+			logrus.WithError(err).WithField("target", target).Debug("close ssh master connection")
+		}
+		cancel()
+	}
+	if err := os.RemoveAll(m.dir); err != nil {
+		logrus.WithError(err).Warn("remove ssh control directory")
+	}
+}
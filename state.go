@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stateDir is a directory where flux keeps state between runs
+type stateDir string
+
+func (d stateDir) path(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+// load reads the json state for name into v, returning false if
+// no state has been saved
+func (d stateDir) load(name string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(d.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// save atomically writes v as json state for name
+func (d stateDir) save(name string, v interface{}) error {
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.path(name + ".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path(name))
+}
+
+func (d stateDir) remove(name string) error {
+	if err := os.Remove(d.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
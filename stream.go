@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var verifyStreamCommand = cli.Command{
+	Name:      "verify-stream",
+	Usage:     "verify send stream files against their recorded sha256",
+	ArgsUsage: "<file...>",
+	Action: func(clix *cli.Context) error {
+		if clix.NArg() == 0 {
+			return errors.New("no stream file specified")
+		}
+		var failed int
+		for _, path := range clix.Args() {
+			if err := verifyStream(path); err != nil {
+				logrus.WithError(err).WithField("file", path).Error("verify stream")
+				failed++
+				continue
+			}
+			logrus.WithField("file", path).Info("stream verified")
+		}
+		if failed > 0 {
+			return checkError(fmt.Sprintf("%d of %d streams failed verification", failed, clix.NArg()))
+		}
+		return nil
+	},
+}
+
+// checksumPath returns the path of the checksum file for the stream file
+func checksumPath(path string) string {
+	return path + ".sha256"
+}
+
+// sendToFile writes the send stream to the file, recording its sha256
+// alongside it in the sha256sum format when checksum is set
+func sendToFile(ctx context.Context, args []string, path string, checksum bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	var (
+		w io.Writer = f
+		h           = sha256.New()
+	)
+	if checksum {
+		w = io.MultiWriter(f, h)
+	}
+	if err := zfsSend(ctx, args, w); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !checksum {
+		return nil
+	}
+	line := hex.EncodeToString(h.Sum(nil)) + "  " + filepath.Base(path) + "\n"
+	return ioutil.WriteFile(checksumPath(path), []byte(line), 0600)
+}
+
+// verifyStream hashes the stream file and compares it with its recorded sha256
+func verifyStream(path string) error {
+	data, err := ioutil.ReadFile(checksumPath(path))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("%s is empty", checksumPath(path))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != fields[0] {
+		return fmt.Errorf("checksum mismatch, recorded %s got %s", fields[0], sum)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+var summaryFlag = cli.StringFlag{
+	Name:  "summary-json",
+	Usage: "write a json summary of every dataset of the run to the file, - for stdout, written on failure too",
+}
+
+var reportFileFlag = cli.StringFlag{
+	Name:  "report-file",
+	Usage: "atomically replace the file with the json report of the run at its end, written on failure too",
+}
+
+// runSummary is the outcome of every dataset of a snapshot run.
+// A nil summary records nothing.
+type runSummary struct {
+	mu       sync.Mutex
+	path     string
+	report   string
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Error    string          `json:"error,omitempty"`
+	Datasets []datasetResult `json:"datasets"`
+}
+
+// datasetResult is the outcome of a single dataset of the run
+type datasetResult struct {
+	Dataset  string `json:"dataset"`
+	Label    string `json:"label,omitempty"`
+	Snapshot string `json:"snapshot,omitempty"`
+	Sent     bool   `json:"sent"`
+	Target   string `json:"target,omitempty"`
+	Dest     string `json:"dest,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	// Seconds is the time taken by the snapshot, send and purge
+	Seconds   float64  `json:"seconds"`
+	Destroyed []string `json:"destroyed,omitempty"`
+	Skipped   bool     `json:"skipped,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	// Stage is the step that failed: snapshot, property, send, purge or
+	// checkpoint
+	Stage string `json:"stage,omitempty"`
+}
+
+func newRunSummary(path, report string) *runSummary {
+	if path == "" && report == "" {
+		return nil
+	}
+	return &runSummary{
+		path:     path,
+		report:   report,
+		Started:  time.Now(),
+		Datasets: []datasetResult{},
+	}
+}
+
+// add records the outcome of the entry, job is nil when the entry failed
+// or was skipped before a snapshot was prepared
+func (s *runSummary) add(e datasetEntry, job *snapshotJob, err error) {
+	if s == nil {
+		return
+	}
+	r := datasetResult{
+		Dataset: e.Name,
+		Label:   e.Label,
+		Skipped: job == nil && err == nil,
+	}
+	if job != nil {
+		if job.snapshot != nil {
+			r.Snapshot = job.snapshot.Name
+		}
+		r.Sent = job.sent
+		r.Bytes = job.bytes.bytes()
+		r.Seconds = time.Since(job.started).Seconds()
+		r.Destroyed = job.destroyed
+		if job.remote != nil {
+			r.Target = job.remote.target
+			r.Dest = e.Dest
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+		r.Stage = "snapshot"
+		if job != nil {
+			r.Stage = job.stage
+		}
+	}
+	s.mu.Lock()
+	s.Datasets = append(s.Datasets, r)
+	s.mu.Unlock()
+}
+
+// skip records the entries left out when the run was aborted
+func (s *runSummary) skip(entries []datasetEntry) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		s.Datasets = append(s.Datasets, datasetResult{
+			Dataset: e.Name,
+			Label:   e.Label,
+			Skipped: true,
+			Error:   "run aborted",
+		})
+	}
+}
+
+// write ends the summary with the error of the run and writes it to its
+// file or stdout and to the report file
+func (s *runSummary) write(runErr error) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Finished = time.Now()
+	if runErr != nil {
+		s.Error = runErr.Error()
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	switch s.path {
+	case "":
+	case "-":
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+	default:
+		if err := ioutil.WriteFile(s.path, data, 0644); err != nil {
+			return err
+		}
+	}
+	if s.report == "" {
+		return nil
+	}
+	return writeFileAtomic(s.report, data)
+}
+
+// writeFileAtomic replaces the file through a temporary file in the same
+// directory so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSummaryStage(t *testing.T) {
+	fail := errors.New("failed")
+	for _, tc := range []struct {
+		name  string
+		job   *snapshotJob
+		err   error
+		stage string
+	}{
+		{name: "prepare", err: fail, stage: "snapshot"},
+		{name: "snapshot", job: &snapshotJob{stage: "snapshot"}, err: fail, stage: "snapshot"},
+		{name: "property", job: &snapshotJob{stage: "property"}, err: fail, stage: "property"},
+		{name: "send", job: &snapshotJob{stage: "send", remote: &remote{target: "backup"}}, err: fail, stage: "send"},
+		{name: "purge", job: &snapshotJob{stage: "purge", sent: true}, err: fail, stage: "purge"},
+		{name: "success", job: &snapshotJob{stage: "checkpoint", sent: true}},
+	} {
+		s := newRunSummary("summary.json", "")
+		if tc.job != nil {
+			tc.job.bytes = &byteCounter{n: new(int64)}
+		}
+		s.add(datasetEntry{Name: "tank/home"}, tc.job, tc.err)
+		if got := s.Datasets[0].Stage; got != tc.stage {
+			t.Errorf("%s: stage %q, want %q", tc.name, got, tc.stage)
+		}
+	}
+}
+
+func TestSendFailedStage(t *testing.T) {
+	job := &snapshotJob{stage: "send"}
+	job.sendFailed(errors.New("broken pipe"))
+	if job.stage != "send" {
+		t.Errorf("stage %q after a failed transfer", job.stage)
+	}
+	job.sendFailed(destPropsError{errors.New("unable to set readonly=on on backup/home")})
+	if job.stage != "property" {
+		t.Errorf("stage %q after failing to set the destination properties", job.stage)
+	}
+}
+
+func TestReportFileReplaced(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		runErr error
+	}{
+		{name: "success"},
+		{name: "failure", runErr: errors.New("send failed for tank/home")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				dir  = t.TempDir()
+				path = filepath.Join(dir, "report.json")
+			)
+			if err := ioutil.WriteFile(path, []byte("previous report\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			// a reader holding the previous report keeps reading it whole
+			prev, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer prev.Close()
+			s := newRunSummary("", path)
+			s.add(datasetEntry{Name: "tank/home"}, nil, tc.runErr)
+			if err := s.write(tc.runErr); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var report runSummary
+			if err := json.Unmarshal(data, &report); err != nil {
+				t.Fatalf("report %q: %v", data, err)
+			}
+			if want := errString(tc.runErr); report.Error != want {
+				t.Errorf("report error %q, want %q", report.Error, want)
+			}
+			if len(report.Datasets) != 1 || report.Datasets[0].Dataset != "tank/home" {
+				t.Errorf("report datasets %+v", report.Datasets)
+			}
+			old, err := ioutil.ReadAll(prev)
+			if err != nil || string(old) != "previous report\n" {
+				t.Errorf("previous report read as %q %v, the file was written in place", old, err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0644 {
+				t.Errorf("report mode %v, want 0644", info.Mode().Perm())
+			}
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Errorf("temporary files left next to the report: %d files", len(files))
+			}
+		})
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/go-zfs"
+	"github.com/urfave/cli"
+)
+
+// reachTimeout bounds the ssh connection check of a target
+const reachTimeout = 15 * time.Second
+
+var validateCommand = cli.Command{
+	Name:      "validate",
+	Usage:     "check the datasets, targets and schedules of a configuration before deploying it and report holds left by interrupted sends",
+	ArgsUsage: "[dataset...]",
+	Flags: append(remoteFlags,
+		cli.StringFlag{
+			Name:  "retention",
+			Usage: "keep the newest snapshots per dataset and label (hourly=24,daily=14), other labels are kept",
+		},
+		labelFlag,
+		scheduleFlag,
+		datasetFileFlag,
+		profileFlag,
+		outputFlag,
+	),
+	Action: func(clix *cli.Context) error {
+		if err := validateOutput(clix.String("output")); err != nil {
+			return err
+		}
+		report := validateConfig(appContext(clix), clix)
+		if err := render(os.Stdout, clix.String("output"), report); err != nil {
+			return err
+		}
+		if len(report.Problems) > 0 {
+			return checkError(fmt.Sprintf("%d configuration problems", len(report.Problems)))
+		}
+		return nil
+	},
+}
+
+// validationReport are all the problems found in a configuration
+type validationReport struct {
+	Datasets int `json:"datasets"`
+	Targets  int `json:"targets"`
+	// Versions are the detected zfs versions of this host, under local,
+	// and of the targets
+	Versions map[string]string `json:"versions"`
+	Problems []string          `json:"problems"`
+}
+
+func (r validationReport) renderText(w io.Writer) error {
+	var hosts []string
+	for h := range r.Versions {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		if _, err := fmt.Fprintf(w, "zfs %s\t%s\n", r.Versions[h], h); err != nil {
+			return err
+		}
+	}
+	for _, p := range r.Problems {
+		if _, err := fmt.Fprintln(w, p); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d datasets, %d targets, %d problems\n", r.Datasets, r.Targets, len(r.Problems))
+	return err
+}
+
+// validateConfig parses the configuration reporting every invalid entry
+// instead of stopping at the first, then checks that the datasets exist
+// and the targets are reachable over ssh
+func validateConfig(ctx context.Context, clix *cli.Context) validationReport {
+	report := validationReport{
+		Versions: make(map[string]string),
+		Problems: []string{},
+	}
+	version := func(name string, v *zfsVersion) {
+		report.Versions[name] = "unknown"
+		if v != nil {
+			report.Versions[name] = v.String()
+		}
+	}
+	version("local", probeVersion(ctx, nil))
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+	defaults, err := defaultEntry(clix)
+	if err != nil {
+		problem("flags: %s", err)
+	}
+	if err := validateTargetUser(clix.String("target-user")); err != nil {
+		problem("flags: %s", err)
+	}
+	if err := validateHostKey(clix.String("target-host-key")); err != nil {
+		problem("flags: %s", err)
+	}
+	var entries []datasetEntry
+	for _, name := range clix.Args() {
+		e := defaults
+		e.Name = name
+		if err := e.validate(); err != nil {
+			problem("%s: %s", name, err)
+			continue
+		}
+		entries = append(entries, e.expand()...)
+	}
+	if path := clix.String("dataset-file"); path != "" {
+		fileEntries, invalid, err := readDatasetFile(path, clix.String("profile"), defaults)
+		if err != nil {
+			problem("%s: %s", path, err)
+		}
+		for _, err := range invalid {
+			problem("%s", err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+	var (
+		datasets = make(map[string]bool)
+		targets  = make(map[string]bool)
+	)
+	for _, e := range entries {
+		if !datasets[e.Name] {
+			datasets[e.Name] = true
+			if _, err := zfs.GetDataset(e.Name); err != nil {
+				problem("dataset %s: %s", e.Name, err)
+			} else if holds, err := sendHolds(appContext(clix), e.Name); err != nil {
+				problem("dataset %s: %s", e.Name, err)
+			} else {
+				for _, h := range holds {
+					problem("snapshot %s: hold %s of an interrupted or running send, zfs release it once no send runs", h.snapshot, h.tag)
+				}
+			}
+		}
+		if e.Target == "" || targets[e.Target] {
+			continue
+		}
+		targets[e.Target] = true
+		r := newRemote(clix, e.Target)
+		if err := reachable(ctx, r); err != nil {
+			problem("target %s: %s", e.Target, err)
+			continue
+		}
+		version(e.Target, probeVersion(ctx, r))
+	}
+	report.Datasets = len(datasets)
+	report.Targets = len(targets)
+	return report
+}
+
+// reachable lists the pools of the remote to check both the ssh
+// connection and the remote zfs
+func reachable(ctx context.Context, r *remote) error {
+	ctx, cancel := context.WithTimeout(ctx, reachTimeout)
+	defer cancel()
+	if out, err := r.zfs(ctx, "list", "-H", "-o", "name", "-d", "0").CombinedOutput(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("no response within %s", reachTimeout)
+		}
+		if len(out) > 0 {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var verifyChainCommand = cli.Command{
+	Name:      "verify-chain",
+	Usage:     "verify the incremental chain between datasets and their remote destination",
+	ArgsUsage: "[dataset...]",
+	Flags: append(remoteFlags,
+		sshMultiplexFlag,
+		depthFlag,
+		sortByFlag,
+		datasetFileFlag,
+		profileFlag,
+		outputFlag,
+	),
+	Action: func(clix *cli.Context) error {
+		if err := validateOutput(clix.String("output")); err != nil {
+			return err
+		}
+		entries, err := datasetEntries(clix)
+		if err != nil {
+			return err
+		}
+		list, err := newListOpts(clix)
+		if err != nil {
+			return err
+		}
+		if err := validateTargetUser(clix.String("target-user")); err != nil {
+			return err
+		}
+		if err := validateHostKey(clix.String("target-host-key")); err != nil {
+			return err
+		}
+		mux, err := newSSHMux(clix)
+		if err != nil {
+			return err
+		}
+		defer mux.close()
+		var (
+			ctx    = appContext(clix)
+			report = chainReport{}
+		)
+		for _, e := range entries {
+			if e.Target == "" {
+				return errors.New("no ssh target specified")
+			}
+			h := remoteHost{
+				ctx:    ctx,
+				remote: mux.add(newRemote(clix, e.Target)),
+			}
+			remoteSnapshots, err := h.snapshots(e.Dest, list)
+			if err != nil {
+				return err
+			}
+			localSnapshots, err := localhost.snapshots(e.Name, list)
+			if err != nil {
+				return err
+			}
+			report = append(report, verifyChain(e.Name, localSnapshots, e.Target, e.Dest, remoteSnapshots)...)
+		}
+		if err := render(os.Stdout, clix.String("output"), report); err != nil {
+			return err
+		}
+		for _, c := range report {
+			if len(c.Problems) > 0 {
+				return checkError("incremental chain verification failed")
+			}
+		}
+		return nil
+	},
+}
+
+// chainReport is the result of verifying the chain of each dataset
+type chainReport []chainResult
+
+type chainResult struct {
+	Dataset    string         `json:"dataset"`
+	Target     string         `json:"target"`
+	Dest       string         `json:"dest"`
+	Common     int            `json:"common"`
+	LastCommon string         `json:"last_common,omitempty"`
+	Problems   []chainProblem `json:"problems"`
+}
+
+type chainProblem struct {
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Hint   string `json:"hint"`
+}
+
+func (r chainReport) renderText(w io.Writer) error {
+	for _, c := range r {
+		if len(c.Problems) == 0 {
+			if _, err := fmt.Fprintf(w, "%s -> %s:%s: chain OK, last common %s\n", c.Dataset, c.Target, c.Dest, c.LastCommon); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s -> %s:%s:\n", c.Dataset, c.Target, c.Dest); err != nil {
+			return err
+		}
+		for _, p := range c.Problems {
+			if _, err := fmt.Fprintf(w, "\t%s: %s\n\t\thint: %s\n", p.Kind, p.Detail, p.Hint); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyChain compares the snapshots of each dataset under source with the
+// matching dataset under dest and reports anything that would break the
+// next incremental send
+func verifyChain(source string, local []*ExtDataset, target, dest string, remote []*ExtDataset) []chainResult {
+	var (
+		localSets  = groupByBase(source, local)
+		remoteSets = groupByBase(dest, remote)
+		bases      []string
+	)
+	for b := range localSets {
+		bases = append(bases, b)
+	}
+	sort.Strings(bases)
+	var out []chainResult
+	for _, b := range bases {
+		out = append(out, verifyDataset(source+b, localSets[b], target, dest+b, remoteSets[b]))
+	}
+	return out
+}
+
+func verifyDataset(source string, local []*ExtDataset, target, dest string, remote []*ExtDataset) chainResult {
+	result := chainResult{
+		Dataset:  source,
+		Target:   target,
+		Dest:     dest,
+		Problems: []chainProblem{},
+	}
+	if len(remote) == 0 {
+		result.Problems = append(result.Problems, chainProblem{
+			Kind:   "missing",
+			Detail: "destination has no snapshots",
+			Hint:   "send the initial snapshot with --init",
+		})
+		return result
+	}
+	onRemote := make(map[string]bool)
+	for _, s := range remote {
+		onRemote[snapshotID(s)] = true
+	}
+	onLocal := make(map[string]bool)
+	first, last := -1, -1
+	for i, s := range local {
+		onLocal[snapshotID(s)] = true
+		if onRemote[snapshotID(s)] {
+			result.Common++
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if last < 0 {
+		result.Problems = append(result.Problems, chainProblem{
+			Kind:   "no-common",
+			Detail: "source and destination have no snapshot in common",
+			Hint:   "send a full stream with --init into a new destination or receive with zfs recv -F",
+		})
+		return result
+	}
+	result.LastCommon = shortName(local[last].Name)
+	var missing []string
+	for _, s := range local[first:last] {
+		if !onRemote[snapshotID(s)] {
+			missing = append(missing, shortName(s.Name))
+		}
+	}
+	if len(missing) > 0 {
+		result.Problems = append(result.Problems, chainProblem{
+			Kind:   "missing-intermediate",
+			Detail: "destination is missing " + strings.Join(missing, ","),
+			Hint:   "the chain continues from " + result.LastCommon + " but history is incomplete, resend with zfs send -I if needed",
+		})
+	}
+	if newest := remote[len(remote)-1]; !onLocal[snapshotID(newest)] {
+		result.Problems = append(result.Problems, chainProblem{
+			Kind:   "diverged",
+			Detail: "newest destination snapshot " + shortName(newest.Name) + " does not exist on the source",
+			Hint:   "roll the destination back to " + result.LastCommon + " with zfs rollback -r",
+		})
+	}
+	return result
+}
+
+// groupByBase groups snapshots by their dataset relative to root
+func groupByBase(root string, snapshots []*ExtDataset) map[string][]*ExtDataset {
+	groups := make(map[string][]*ExtDataset)
+	for _, s := range snapshots {
+		rel := strings.TrimPrefix(s.BaseName, root)
+		groups[rel] = append(groups[rel], s)
+	}
+	return groups
+}
+
+// shortName returns the snapshot name without its dataset
+func shortName(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// zfsVersion is the version of the zfs userland of a host
+type zfsVersion struct {
+	major, minor, patch int
+	raw                 string
+}
+
+func (v zfsVersion) String() string {
+	return v.raw
+}
+
+// atLeast returns true when the version is the same or newer than o
+func (v zfsVersion) atLeast(o zfsVersion) bool {
+	if v.major != o.major {
+		return v.major > o.major
+	}
+	if v.minor != o.minor {
+		return v.minor > o.minor
+	}
+	return v.patch >= o.patch
+}
+
+// sendOptVersions are the zfs versions first supporting the send options,
+// on the sending and on the receiving side
+var sendOptVersions = []struct {
+	flag    string
+	version zfsVersion
+	used    func(o sendOpts) bool
+}{
+	{"--large-blocks", zfsVersion{0, 6, 5, "0.6.5"}, func(o sendOpts) bool { return o.largeBlocks }},
+	{"--embed", zfsVersion{0, 6, 5, "0.6.5"}, func(o sendOpts) bool { return o.embed }},
+	{"--compressed-stream", zfsVersion{0, 7, 0, "0.7.0"}, func(o sendOpts) bool { return o.compressed }},
+	{"--redact", zfsVersion{2, 0, 0, "2.0.0"}, func(o sendOpts) bool { return o.redact != "" }},
+}
+
+// versionCache keeps the probed versions for the rest of the run, the
+// local host is cached under the empty target
+var versionCache = struct {
+	sync.Mutex
+	versions map[string]*zfsVersion
+}{versions: make(map[string]*zfsVersion)}
+
+// probeVersion returns the zfs version of the local host, or of the remote
+// when set, nil when it cannot be detected
+func probeVersion(ctx context.Context, r *remote) *zfsVersion {
+	target := ""
+	if r != nil {
+		target = r.target
+	}
+	versionCache.Lock()
+	defer versionCache.Unlock()
+	if v, ok := versionCache.versions[target]; ok {
+		return v
+	}
+	var cmd *exec.Cmd
+	if r != nil {
+		cmd = r.zfs(ctx, "version")
+	} else {
+		cmd = command(ctx, "zfs", "version")
+	}
+	out, err := cmd.Output()
+	if err != nil && r == nil {
+		// zfs version was added in OpenZFS 0.8, older modules on linux
+		// still report theirs
+		out, err = ioutil.ReadFile("/sys/module/zfs/version")
+	}
+	var v *zfsVersion
+	if err == nil {
+		v = parseZFSVersion(string(out))
+	}
+	if v == nil {
+		logrus.WithField("target", target).Debug("unable to detect the zfs version")
+	}
+	versionCache.versions[target] = v
+	return v
+}
+
+// parseZFSVersion parses the first line of zfs version (zfs-2.1.5-1) or
+// the version of the kernel module (0.7.12-1)
+func parseZFSVersion(out string) *zfsVersion {
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(out), "\n", 2)[0])
+	raw := strings.TrimPrefix(line, "zfs-")
+	if i := strings.IndexAny(raw, "-_"); i >= 0 {
+		raw = raw[:i]
+	}
+	parts := strings.Split(raw, ".")
+	if len(parts) < 2 {
+		return nil
+	}
+	var n [3]int
+	for i := 0; i < len(parts) && i < 3; i++ {
+		v, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return nil
+		}
+		n[i] = v
+	}
+	return &zfsVersion{major: n[0], minor: n[1], patch: n[2], raw: raw}
+}
+
+// checkVersions ensures the zfs of the source and of the destination
+// support the send options. Hosts whose version cannot be detected are
+// left to fail on the send itself.
+func checkVersions(ctx context.Context, r *remote, opts sendOpts) error {
+	var (
+		local = probeVersion(ctx, nil)
+		dst   = probeVersion(ctx, r)
+	)
+	for _, o := range sendOptVersions {
+		if !o.used(opts) {
+			continue
+		}
+		if local != nil && !local.atLeast(o.version) {
+			return fmt.Errorf("zfs %s on this host does not support %s, it requires zfs %s", local, o.flag, o.version)
+		}
+		if dst != nil && !dst.atLeast(o.version) {
+			return fmt.Errorf("zfs %s on %s does not support %s, it requires zfs %s", dst, r.target, o.flag, o.version)
+		}
+	}
+	return nil
+}